@@ -2,297 +2,3915 @@ package lognorth
 
 import (
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"math"
+	mathrand "math/rand/v2"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
+	"weak"
 )
 
-type event struct {
-	Message    string         `json:"message"`
-	Timestamp  string         `json:"timestamp"`
-	DurationMS int            `json:"duration_ms"`
-	TraceID    string         `json:"trace_id,omitempty"`
-	Context    map[string]any `json:"context,omitempty"`
+// Event is a single log event as sent to the LogNorth batch endpoint. The JSON
+// field names are the wire contract and will not change:
+//
+//	id              client-assigned event ID (see ContentEventID), omitted when empty
+//	level           slog level name: DEBUG, INFO, WARN, ERROR
+//	message         the log message
+//	timestamp       RFC 3339 time in UTC
+//	duration_ms     request duration, set by Middleware (0 otherwise)
+//	trace_id        trace ID, omitted when empty
+//	span_id         span ID from a TraceExtractor, omitted when empty
+//	template        message template lifted by TemplateKey, omitted when empty
+//	correlation_id  correlation ID lifted by CorrelationKey, omitted when empty
+//	batch_id        ID of the batch the event was first sent in, kept on retries
+//	context         structured attrs, omitted when empty
+type Event struct {
+	ID            string         `json:"id,omitempty"`
+	Level         string         `json:"level,omitempty"`
+	Message       string         `json:"message"`
+	Timestamp     string         `json:"timestamp"`
+	DurationMS    int            `json:"duration_ms"`
+	TraceID       string         `json:"trace_id,omitempty"`
+	SpanID        string         `json:"span_id,omitempty"`
+	Template      string         `json:"template,omitempty"`
+	CorrelationID string         `json:"correlation_id,omitempty"`
+	BatchID       string         `json:"batch_id,omitempty"`
+	Context       map[string]any `json:"context,omitempty"`
+
+	queued time.Time   // when the event entered the buffer
+	dest   destination // set by KeyResolver; zero means the Sender's own
+	size   int         // serialized size, tracked only with FlushBytes
+	tries  int         // failed delivery attempts so far
+	retry  time.Time   // earliest timed resend after a failed attempt
+	replay bool        // read back from the spool by Replay
+}
+
+// NewEvent converts a slog record into an Event, the same way Handler does
+// for non-error records. It is useful for custom transports and adapters.
+func NewEvent(r slog.Record) Event {
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return Event{
+		Level:     r.Level.String(),
+		Message:   r.Message,
+		Timestamp: t.UTC().Format(time.RFC3339),
+		Context:   recordContext(nil, nil, r, 0),
+	}
+}
+
+type ctxKey int
+
+const (
+	traceIDKey ctxKey = iota
+	noLogKey
+	deliveredKey    // *atomic.Int64 counting the events FlushN delivered
+	requestAttrsKey // *requestAttrs collected by AddRequestAttr
+)
+
+// requestAttrs holds the attrs added to one request by AddRequestAttr.
+type requestAttrs struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// AddRequestAttr attaches key and value to the request event Middleware logs
+// once the request carried by ctx completes, so handlers deep in the stack
+// can annotate it. Fields set by Middleware itself, such as status, are not
+// overridden. Outside Middleware it does nothing. It is safe for concurrent
+// use.
+func AddRequestAttr(ctx context.Context, key string, value any) {
+	if ra, ok := ctx.Value(requestAttrsKey).(*requestAttrs); ok {
+		ra.mu.Lock()
+		ra.attrs = append(ra.attrs, slog.Any(key, value))
+		ra.mu.Unlock()
+	}
+}
+
+// ContextWithNoLog marks ctx so Middleware skips the access log for requests
+// carrying it. Set it in a handler wrapped around Middleware, e.g. for
+// health-check probes. Panics are still reported.
+func ContextWithNoLog(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noLogKey, true)
+}
+
+// ContextWithTraceID attaches traceID to ctx, as Middleware does. Records
+// logged with the returned context (e.g. slog.InfoContext) carry it as their
+// trace_id, which ties background jobs and workers to a trace.
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey, traceID)
+}
+
+func traceIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if v, ok := ctx.Value(traceIDKey).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// ContentEventID is the default event ID: a hash of the timestamp, message,
+// and context, so a retried event keeps its ID across process restarts and the
+// server can dedup it. Identical events logged within the same second share an
+// ID; use EventIDFunc if that matters.
+func ContentEventID(e Event) string {
+	if e.Context == nil {
+		// The same bytes as below, with "null\n" being what Encode writes for
+		// a nil map, hashed from a stack buffer instead of a heap digest.
+		var buf [256]byte
+		b := append(buf[:0], e.Timestamp...)
+		b = append(b, 0)
+		b = append(b, e.Message...)
+		b = append(b, 0)
+		b = append(b, "null\n"...)
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:16])
+	}
+	h := sha256.New()
+	h.Write([]byte(e.Timestamp))
+	h.Write([]byte{0})
+	h.Write([]byte(e.Message))
+	h.Write([]byte{0})
+	// encoding/json sorts map keys, which makes this deterministic.
+	json.NewEncoder(h).Encode(e.Context)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// eventID returns the ID for e from EventIDFunc or ContentEventID.
+func (s *Sender) eventID(e Event) string {
+	if fn := s.options().eventIDFunc; fn != nil {
+		return fn(e)
+	}
+	return ContentEventID(e)
+}
+
+func generateTraceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Sender owns the buffer, flush timer, and backoff state for one batch stream.
+// Handlers created from the same Sender keep their own attrs but share the
+// buffer, so their events go out together in merged batches.
+type Sender struct {
+	mu       sync.Mutex
+	apiKey   string
+	endpoint string
+	buffer   []Event
+	bytes    int        // sum of buffered Event.size
+	space    *sync.Cond // signaled when a flush frees buffer room
+	timer    *time.Timer
+	deadline time.Time // when timer fires, for tests
+	deferred int       // timed flushes skipped under MinBatchSize
+	backoff  time.Time
+	degraded bool
+	interval time.Duration
+	tokens   float64          // retry budget left, see RetryBudgetPerSecond
+	refilled time.Time        // when tokens was last topped up
+	now      func() time.Time // for tests; nil means time.Now
+	client   *http.Client
+	opts     options
+	inflight sync.WaitGroup // sends started in the background
+	seen     messageLRU     // messages seen under KeepFirst sampling
+	rngMu    sync.Mutex
+	rng      *mathrand.Rand   // SampleSeed generator, created on first use
+	sem      chan struct{}    // request slots under GlobalMaxConcurrency
+	beatStop chan struct{}    // closes to stop the heartbeat goroutine
+	beatTick <-chan time.Time // for tests; nil means a ticker every HeartbeatInterval
+	beats    sync.WaitGroup   // the heartbeat goroutine
+	sinkMu   sync.Mutex       // serializes WriterSink writes
+	spoolMu  sync.Mutex       // serializes spool appends and rotation
+
+	spoolErrors bool // the active spool file holds error events; guarded by spoolMu
+
+	errQueue  []Event // unbuffered errors waiting for the error worker
+	errWorker bool    // whether drainErrors is running
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+	expired atomic.Uint64
+	failed  atomic.Uint64
+
+	transportErrors atomic.Uint64
+	clientErrors    atomic.Uint64
+	serverErrors    atomic.Uint64
+	rateLimited     atomic.Uint64
+	spooled         atomic.Uint64
+
+	flushing atomic.Bool // a background flush is pending or running
+}
+
+// NewSender creates a Sender for the given endpoint and API key.
+func NewSender(url, key string, opts ...Option) *Sender {
+	o := newOptions(opts)
+	s := &Sender{endpoint: url, apiKey: keyFromFile(key, o), opts: o}
+	s.mu.Lock()
+	s.startHeartbeat()
+	s.mu.Unlock()
+	track(s)
+	return s
+}
+
+// live holds the Senders made by NewSender, so the signal handler flushes
+// them along with the default one. The pointers are weak: tracking never
+// keeps an abandoned Sender alive.
+var live = struct {
+	sync.Mutex
+	senders map[weak.Pointer[Sender]]struct{}
+}{senders: make(map[weak.Pointer[Sender]]struct{})}
+
+func track(s *Sender) {
+	p := weak.Make(s)
+	live.Lock()
+	live.senders[p] = struct{}{}
+	live.Unlock()
+	runtime.AddCleanup(s, func(p weak.Pointer[Sender]) {
+		live.Lock()
+		delete(live.senders, p)
+		live.Unlock()
+	}, p)
+}
+
+// shutdownAll flushes the default Sender and every live one concurrently,
+// each within its own ShutdownGrace.
+func shutdownAll() {
+	senders := []*Sender{std}
+	live.Lock()
+	for p := range live.senders {
+		if s := p.Value(); s != nil {
+			senders = append(senders, s)
+		}
+	}
+	live.Unlock()
+	var wg sync.WaitGroup
+	for _, s := range senders {
+		wg.Go(func() { s.shutdown() })
+	}
+	wg.Wait()
+}
+
+const (
+	defaultShutdownGrace     = 5 * time.Second
+	defaultErrorSendTimeout  = 10 * time.Second
+	defaultCorrelationKey    = "correlation_id"
+	defaultFlushInterval     = 5 * time.Second
+	defaultBatchSize         = 10
+	defaultMaxDeferrals      = 1
+	defaultMaxFlushInterval  = time.Minute
+	defaultRetryDelay        = time.Second
+	defaultBackoffMultiplier = 2
+	defaultRecoveryFactor    = 0.9
+	defaultTraceHeader       = "X-Trace-ID"
+)
+
+type options struct {
+	bufferErrors    bool
+	errorsBypass    bool
+	beforeSend      func(Event) (Event, bool)
+	shutdownGrace   time.Duration
+	errorTimeout    time.Duration
+	errorRetries    int
+	batchRetries    int
+	errorRetriesSet bool
+	batchRetriesSet bool
+	retryDelay      time.Duration
+	heartbeat       time.Duration
+	flushTimeout    time.Duration
+	dryRun          io.Writer
+	maxEventAge     time.Duration
+	batchSize       int
+	minBatchSize    int
+	maxDeferrals    int
+	maxBatchBytes   int
+	flushBytes      int
+	marshaler       func(v any) ([]byte, error)
+	encoding        Encoding
+	ceSource        string
+	compress        []string
+	levelMapper     func(slog.Level) string
+
+	includeBuildInfo bool
+	includeCounts    bool
+	includeK8s       bool
+	k8sEnv           map[string]string
+	k8sFields        map[string]any
+	errorEndpoint    string
+	sampled          bool
+	sampleRate       float64
+	sampleMode       SampleMode
+	sampleSeeded     bool
+	sampleSeed       int64
+	maxBufferSize    int
+	softBufferSize   int
+	blockOnFull      time.Duration
+	overflowWriter   io.Writer
+	fallback         slog.Handler
+
+	client          *http.Client
+	maxIdleConns    int
+	maxConnsPerHost int
+	maxConcurrency  int
+	http2Set        bool
+	http2           bool
+	idleConnTimeout time.Duration
+	apiKeyFile      string
+	apiKeyFunc      func() (string, error)
+	signingSecret   []byte
+	tlsConfig       *tls.Config
+	tlsMinVersion   uint16
+	cipherSuites    []uint16
+
+	onDelivered func(ids []string)
+	onError     func(err error)
+	onResponse  func(status int, body []byte)
+	shouldRetry func(resp *http.Response, err error) bool
+	transport   Transport
+	writerSink  io.Writer
+	spoolDir    string
+	spoolMax    int64
+	eventSink   chan<- Event
+	eventIDFunc func(Event) string
+
+	retryBudget       float64
+	flushAt           time.Duration
+	backoffMultiplier float64
+	recoveryFactor    float64
+	maxFlushInterval  time.Duration
+
+	pathNormalizer func(*http.Request) string
+	recoverPanics  bool
+	logStart       bool
+	traceHeader    string
+	traceIDGen     func() string
+	requestID      func(context.Context) string
+
+	slowRequestThreshold time.Duration
+	latencyBuckets       []time.Duration
+	captureHeaders       []string
+	captureQueryParams   []string
+	trustProxyHeaders    bool
+	skipPaths            []string
+
+	traceExtractor    func(context.Context) (traceID, spanID string)
+	contextExtractors []func(context.Context) []slog.Attr
+	levelFields       map[slog.Level][]slog.Attr
+	keyResolver       func(context.Context) (apiKey, endpoint string)
+	templateKey       string
+	correlationKey    string
+	stringifyContext  bool
+	maxAttrs          int
+	maxStringLen      int
+	keepZeroTime      bool
+	sendMinSet        bool
+	sendMinLevel      slog.Level
+}
+
+// newOptions applies opts and resolves anything read once at construction.
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.includeK8s {
+		env := o.k8sEnv
+		if env == nil {
+			env = defaultK8sEnv
+		}
+		o.k8sFields = make(map[string]any)
+		for field, name := range env {
+			if v := os.Getenv(name); v != "" {
+				o.k8sFields[field] = v
+			}
+		}
+	}
+	return o
+}
+
+// Option tunes a Sender. Pass options to Config or NewSender.
+type Option func(*options)
+
+// BufferErrors routes error events through the normal buffer so they go out
+// with the next batch instead of in their own immediate request.
+func BufferErrors(enabled bool) Option {
+	return func(o *options) { o.bufferErrors = enabled }
+}
+
+// ErrorsBypassBackoff lets immediate error sends go out while batches are
+// paused after a 429, instead of being spooled or dropped with them.
+func ErrorsBypassBackoff(enabled bool) Option {
+	return func(o *options) { o.errorsBypass = enabled }
+}
+
+func (s *Sender) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// std is the Sender behind the package-level functions and NewHandler.
+var std = &Sender{}
+
+func init() {
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		sig := <-c
+		shutdownAll()
+
+		// Hand the signal back to the default handler so the process exits
+		// the way it would have without us.
+		signal.Stop(c)
+		if p, err := os.FindProcess(os.Getpid()); err != nil || p.Signal(sig) != nil {
+			os.Exit(1)
+		}
+	}()
+}
+
+// httpClient returns the client for sends: HTTPClient if set, otherwise a
+// client with a tuned transport when pool options are set, otherwise
+// http.DefaultClient.
+func (s *Sender) httpClient() *http.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.client != nil {
+		return s.opts.client
+	}
+	if s.client != nil {
+		return s.client
+	}
+	tlsSet := s.opts.tlsConfig != nil || s.opts.tlsMinVersion != 0 || len(s.opts.cipherSuites) > 0
+	if s.opts.maxIdleConns == 0 && s.opts.maxConnsPerHost == 0 && s.opts.idleConnTimeout == 0 && !tlsSet && !s.opts.http2Set {
+		return http.DefaultClient
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if s.opts.maxIdleConns > 0 {
+		t.MaxIdleConns = s.opts.maxIdleConns
+		t.MaxIdleConnsPerHost = s.opts.maxIdleConns
+	}
+	if s.opts.maxConnsPerHost > 0 {
+		t.MaxConnsPerHost = s.opts.maxConnsPerHost
+	}
+	if s.opts.idleConnTimeout > 0 {
+		t.IdleConnTimeout = s.opts.idleConnTimeout
+	}
+	if tlsSet {
+		cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+		if s.opts.tlsConfig != nil {
+			cfg = s.opts.tlsConfig.Clone()
+		}
+		if s.opts.tlsMinVersion != 0 {
+			cfg.MinVersion = s.opts.tlsMinVersion
+		}
+		if len(s.opts.cipherSuites) > 0 {
+			cfg.CipherSuites = s.opts.cipherSuites
+		}
+		t.TLSClientConfig = cfg
+	}
+	if s.opts.http2Set {
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		if s.opts.http2 {
+			// One multiplexed connection, kept alive with pings so a dead
+			// peer is noticed before the next batch stalls on it.
+			protocols.SetHTTP2(true)
+			t.ForceAttemptHTTP2 = true
+			t.HTTP2 = &http.HTTP2Config{SendPingTimeout: 30 * time.Second, PingTimeout: 15 * time.Second}
+		} else {
+			t.ForceAttemptHTTP2 = false
+		}
+		t.Protocols = &protocols
+	}
+	s.client = &http.Client{Transport: t}
+	return s.client
+}
+
+// options returns a copy of the current options.
+func (s *Sender) options() options {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opts
+}
+
+// shutdown flushes the buffer, waiting at most the configured grace period.
+func (s *Sender) shutdown() error {
+	grace := s.options().shutdownGrace
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return s.FlushContext(ctx)
+}
+
+// ErrorFields are the structured error fields added to context for error events.
+// SDKs populate these automatically; the server uses them for three-tier issue grouping.
+type ErrorFields struct {
+	Error       string `json:"error"`
+	ErrorClass  string `json:"error_class"`
+	ErrorFile   string `json:"error_file"`
+	ErrorLine   int    `json:"error_line"`
+	ErrorCaller string `json:"error_caller"`
+	StackTrace  string `json:"stack_trace"`
+
+	// ErrorFunction is the package-qualified name of the calling function.
+	ErrorFunction string `json:"error_function"`
+
+	// ErrorType is the deepest meaningful type in the %w chain.
+	ErrorType string `json:"error_type"`
+	// ErrorChain lists each wrapped layer's message and type, outermost first.
+	// Only present when the error wraps another.
+	ErrorChain []map[string]any `json:"error_chain,omitempty"`
+}
+
+// BeforeSend sets a hook called for each event just before it is sent. The
+// hook may return a modified event, or false to drop the event entirely.
+func BeforeSend(fn func(e Event) (Event, bool)) Option {
+	return func(o *options) { o.beforeSend = fn }
+}
+
+// ShutdownGrace bounds how long the SIGINT/SIGTERM handler waits for the final
+// flush of the Sender before letting the process exit. Every Sender is
+// flushed at once, so the exit waits for the longest grace. Defaults to 5
+// seconds.
+func ShutdownGrace(d time.Duration) Option {
+	return func(o *options) { o.shutdownGrace = d }
+}
+
+// ErrorRetries sets how many times an error event rejected with a retryable
+// status (5xx or 408) is resent before it is spooled or dropped. Defaults to
+// 3; zero sends each error event once.
+func ErrorRetries(n int) Option {
+	return func(o *options) { o.errorRetries, o.errorRetriesSet = n, true }
+}
+
+// BatchRetries is ErrorRetries for all other events. Defaults to 1.
+func BatchRetries(n int) Option {
+	return func(o *options) { o.batchRetries, o.batchRetriesSet = n, true }
+}
+
+// RetryDelay sets how long an event waits after a failed attempt before a
+// timed flush resends it, doubling with each further attempt up to
+// MaxFlushInterval. Defaults to one second. Explicit flushes resend at once.
+func RetryDelay(d time.Duration) Option {
+	return func(o *options) { o.retryDelay = d }
+}
+
+// retryWait returns how long an event waits before its attempt after tries
+// failed ones.
+func (o options) retryWait(tries int) time.Duration {
+	d, ceiling := cmp.Or(o.retryDelay, defaultRetryDelay), cmp.Or(o.maxFlushInterval, defaultMaxFlushInterval)
+	for i := 1; i < tries && d < ceiling; i++ {
+		d *= 2
+	}
+	return min(d, ceiling)
+}
+
+// retries returns the retry allowance for error or other events.
+func (o options) retries(isError bool) int {
+	if isError {
+		if o.errorRetriesSet {
+			return o.errorRetries
+		}
+		return defaultErrorRetries
+	}
+	if o.batchRetriesSet {
+		return o.batchRetries
+	}
+	return defaultBatchRetries
+}
+
+// ErrorSendTimeout bounds each background send of immediate error events,
+// so a slow endpoint cannot hold the error worker indefinitely. Defaults to
+// 10 seconds.
+func ErrorSendTimeout(d time.Duration) Option {
+	return func(o *options) { o.errorTimeout = d }
+}
+
+// FlushTimeout bounds each timer or batch-size flush to d. A send still
+// running at the deadline is abandoned and its events are buffered again for
+// the next flush. Explicit Flush calls are unaffected. Zero means no limit.
+func FlushTimeout(d time.Duration) Option {
+	return func(o *options) { o.flushTimeout = d }
+}
+
+// HeartbeatInterval sends a "heartbeat" event every d, even when the app logs
+// nothing, so silence from a live process can be told apart from one that is
+// down. It runs until Close. Zero disables it.
+func HeartbeatInterval(d time.Duration) Option {
+	return func(o *options) { o.heartbeat = d }
+}
+
+// DryRun writes each outbound batch to w instead of sending it. Batching and
+// timers run as usual. A nil w writes to stderr.
+func DryRun(w io.Writer) Option {
+	if w == nil {
+		w = os.Stderr
+	}
+	return func(o *options) { o.dryRun = w }
+}
+
+// Marshaler replaces encoding/json.Marshal for encoding batches and overflow
+// events, e.g. with a faster drop-in library. Its output is sent verbatim.
+func Marshaler(fn func(v any) ([]byte, error)) Option {
+	return func(o *options) { o.marshaler = fn }
+}
+
+// Encoding selects the wire format of batch requests.
+type Encoding int
+
+const (
+	JSON     Encoding = iota // application/json, the default
+	Protobuf                 // application/x-protobuf, see lognorth.proto
+
+	// CloudEvents sends each batch as a CloudEvents 1.0 structured-mode
+	// batch (application/cloudevents-batch+json), one envelope per event
+	// with the event as its data and its ID as the envelope id. Batch
+	// metadata is not sent.
+	CloudEvents
+
+	// CloudEventsBinary sends each event in its own request in CloudEvents
+	// binary mode: the attributes travel as ce-* headers and the body is the
+	// JSON event.
+	CloudEventsBinary
+)
+
+// WithEncoding sets the wire format of batches sent to the endpoint.
+// Marshaler applies to JSON and the CloudEvents encodings; DryRun,
+// WriterSink, the spool, and a Transport keep using JSON events.
+func WithEncoding(enc Encoding) Option {
+	return func(o *options) { o.encoding = enc }
+}
+
+// CloudEventsSource sets the source attribute of events sent with a
+// CloudEvents encoding, e.g. "/checkout-service". Defaults to
+// "lognorth-sdk-go".
+func CloudEventsSource(source string) Option {
+	return func(o *options) { o.ceSource = source }
+}
+
+const (
+	cloudEventType          = "com.lognorth.log"
+	defaultCloudEventSource = "lognorth-sdk-go"
+)
+
+// cloudEventAttrs returns the CloudEvents context attributes for e. The id is
+// the event ID, which survives retries, so consumers deduping on source and
+// id see a resent event once; events without one get a random id.
+func cloudEventAttrs(o options, e Event) map[string]any {
+	attrs := map[string]any{
+		"specversion": "1.0",
+		"type":        cloudEventType,
+		"source":      cmp.Or(o.ceSource, defaultCloudEventSource),
+		"id":          cmp.Or(e.ID, generateTraceID()),
+	}
+	if e.Timestamp != "" {
+		attrs["time"] = e.Timestamp
+	}
+	return attrs
+}
+
+// cloudEventBatch wraps events in structured-mode CloudEvents envelopes.
+func cloudEventBatch(o options, events []Event) []map[string]any {
+	batch := make([]map[string]any, len(events))
+	for i, e := range events {
+		ce := cloudEventAttrs(o, e)
+		ce["datacontenttype"] = "application/json"
+		ce["data"] = e
+		batch[i] = ce
+	}
+	return batch
+}
+
+// codecs holds the request body compressors by Content-Encoding name.
+var codecs = struct {
+	sync.RWMutex
+	m map[string]func([]byte) ([]byte, error)
+}{m: map[string]func([]byte) ([]byte, error){"gzip": gzipBody}}
+
+// RegisterCodec makes a body compressor available to Compress under its
+// Content-Encoding name. Codec modules such as lognorthzstd call it from
+// init. It is safe for concurrent use.
+func RegisterCodec(name string, compress func(body []byte) ([]byte, error)) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[name] = compress
+}
+
+// Compress compresses request bodies with the first of names that is
+// registered, so Compress("zstd", "gzip") falls back to gzip when the zstd
+// module is not linked in, and to no compression when none are. gzip is
+// always available.
+func Compress(names ...string) Option {
+	return func(o *options) { o.compress = names }
+}
+
+// negotiateCodec picks the first registered codec of names.
+func negotiateCodec(names []string) (string, func([]byte) ([]byte, error)) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	for _, name := range names {
+		if fn, ok := codecs.m[name]; ok {
+			return name, fn
+		}
+	}
+	return "", nil
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// marshal encodes v with the configured Marshaler, or encoding/json.
+func (o options) marshal(v any) ([]byte, error) {
+	if o.marshaler != nil {
+		return o.marshaler(v)
+	}
+	return json.Marshal(v)
+}
+
+// LevelMapper controls the level string sent for each slog level, e.g. to
+// send "warning" for LevelWarn or syslog numbers. The default is
+// slog.Level.String.
+func LevelMapper(fn func(slog.Level) string) Option {
+	return func(o *options) { o.levelMapper = fn }
+}
+
+// levelName returns the level string sent for l.
+func (o options) levelName(l slog.Level) string {
+	if o.levelMapper != nil {
+		return o.levelMapper(l)
+	}
+	return l.String()
+}
+
+// OnDelivered sets a callback that receives the IDs of events the server
+// accepted, once per successful send.
+func OnDelivered(fn func(ids []string)) Option {
+	return func(o *options) { o.onDelivered = fn }
+}
+
+// OnError sets a callback that receives every failed send. The error wraps
+// one of ErrTransport, ErrClient, ErrServer or ErrRateLimited; use errors.Is
+// or errors.As to tell network trouble from server-side rejections.
+func OnError(fn func(err error)) Option {
+	return func(o *options) { o.onError = fn }
+}
+
+// EventSink makes every event accepted for delivery also go to ch, with the
+// ID it is sent under, e.g. for local aggregation or a second sink. Sends
+// never block: when ch is full the event is skipped for ch but still
+// delivered to the server as usual.
+func EventSink(ch chan<- Event) Option {
+	return func(o *options) { o.eventSink = ch }
+}
+
+// Transport delivers batches somewhere other than the LogNorth HTTP API,
+// such as a queue. Send gets the events after BeforeSend; a returned error
+// counts as an ErrTransport failure for the whole batch, unless it is a
+// *PartialError naming the events that were not delivered.
+type Transport interface {
+	Send(ctx context.Context, events []Event) error
+}
+
+// PartialError is returned by a Transport that delivered only part of a
+// batch. Failed holds the indexes, into the events given to Send, of those
+// that were not delivered; only they are retried, within the retry limits,
+// so the rest are not written twice.
+type PartialError struct {
+	Failed []int
+	Err    error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d events not delivered: %v", len(e.Failed), e.Err)
+}
+
+func (e *PartialError) Unwrap() error { return e.Err }
+
+// WithTransport replaces HTTP delivery with t. Endpoint, key, and the HTTP
+// options are then unused.
+func WithTransport(t Transport) Option {
+	return func(o *options) { o.transport = t }
+}
+
+// WriterSink makes sends write each batch to w as one line of JSON, in the
+// same {"events": [...]} shape as the HTTP body, instead of POSTing it. A
+// separate agent can then ship the file. Writes are serialized.
+func WriterSink(w io.Writer) Option {
+	return func(o *options) { o.writerSink = w }
+}
+
+// SpoolDir makes events that fail to send because of the network, a 5xx once
+// retries are spent, or a 429 backoff go to gzip-compressed files in dir
+// instead of being dropped. Replay sends them later. Events routed by
+// KeyResolver are spooled with their endpoint and API key, so the files are
+// created readable by the owner only.
+func SpoolDir(dir string) Option {
+	return func(o *options) { o.spoolDir = dir }
+}
+
+// FallbackHandler receives the events the SDK cannot deliver, e.g. a
+// slog.NewTextHandler on stderr, so logs are not lost entirely: everything
+// when no endpoint is configured, and events dropped after network failures,
+// spent retries, 429 backoff, or a 4xx rejection. With SpoolDir set, only
+// events that fail to spool reach it.
+func FallbackHandler(h slog.Handler) Option {
+	return func(o *options) { o.fallback = h }
+}
+
+// SpoolMaxBytes caps the total size of the compressed spool files. Past it
+// the oldest segments are deleted, those without error events first, and
+// their events count as dropped. Zero means no cap.
+func SpoolMaxBytes(n int64) Option {
+	return func(o *options) { o.spoolMax = n }
+}
+
+// hasSink reports whether events are delivered without an endpoint.
+func (o options) hasSink() bool {
+	return o.transport != nil || o.writerSink != nil
+}
+
+// OnResponse sets a hook called with the raw status and (decompressed) body of
+// every response, e.g. to log server-assigned ingest IDs.
+func OnResponse(fn func(status int, body []byte)) Option {
+	return func(o *options) { o.onResponse = fn }
+}
+
+// EventIDFunc replaces ContentEventID as the way event IDs are assigned.
+func EventIDFunc(fn func(e Event) string) Option {
+	return func(o *options) { o.eventIDFunc = fn }
+}
+
+// ShouldRetry overrides which failed sends are retried. It is called with
+// the response, whose body is still readable, for statuses of 300 and above
+// other than 413 and 429, and with a nil response and the error when the
+// request or Transport fails. Retries it allows count against ErrorRetries
+// and BatchRetries. By default server errors and 408 are retried, transport
+// failures are retried for error events only, and other responses are final.
+func ShouldRetry(fn func(resp *http.Response, err error) bool) Option {
+	return func(o *options) { o.shouldRetry = fn }
+}
+
+// FlushAt aligns timed flushes to wall-clock multiples of d, e.g. every
+// minute on the minute, instead of a flush interval after the oldest event.
+// Batch-size and explicit flushes are unaffected.
+func FlushAt(d time.Duration) Option {
+	return func(o *options) { o.flushAt = d }
+}
+
+// RetryBudgetPerSecond caps how many batches of previously failed events are
+// resent per second across the whole Sender, so retries can't pile onto a
+// recovering server. Over budget, such batches stay buffered without a
+// request or a spent retry until the next token is due, and the send returns
+// ErrRetryBudget. Zero means no budget.
+func RetryBudgetPerSecond(n float64) Option {
+	return func(o *options) { o.retryBudget = n }
+}
+
+// BackoffMultiplier sets how much the flush interval grows on each 429.
+// Defaults to 2.
+func BackoffMultiplier(f float64) Option {
+	return func(o *options) { o.backoffMultiplier = f }
+}
+
+// RecoveryFactor sets how much the flush interval shrinks on each successful
+// send, back toward the 5 second base. Defaults to 0.9.
+func RecoveryFactor(f float64) Option {
+	return func(o *options) { o.recoveryFactor = f }
+}
+
+// MaxFlushInterval caps how far 429s can stretch the flush interval.
+// Defaults to one minute.
+func MaxFlushInterval(d time.Duration) Option {
+	return func(o *options) { o.maxFlushInterval = d }
+}
+
+// BatchSize sets how many buffered events trigger a flush and the most events
+// sent in one request. Defaults to 10.
+func BatchSize(n int) Option {
+	return func(o *options) { o.batchSize = n }
+}
+
+// MaxBatchBytes caps the JSON size of one request. Larger backlogs are split
+// across several sequential requests. Zero means no byte cap.
+func MaxBatchBytes(n int) Option {
+	return func(o *options) { o.maxBatchBytes = n }
+}
+
+// FlushBytes starts a flush once the buffered events serialize to at least n
+// bytes, bounding memory when events are large. It complements the count-based
+// BatchSize trigger. Zero disables it.
+func FlushBytes(n int) Option {
+	return func(o *options) { o.flushBytes = n }
+}
+
+// defaultK8sEnv maps event fields to the downward API variables they are read
+// from by IncludeK8sMetadata.
+var defaultK8sEnv = map[string]string{
+	"k8s_pod":       "POD_NAME",
+	"k8s_namespace": "POD_NAMESPACE",
+	"k8s_node":      "NODE_NAME",
+}
+
+// IncludeK8sMetadata adds the pod name, namespace, and node from the
+// Kubernetes downward API (POD_NAME, POD_NAMESPACE, NODE_NAME) to every
+// event's context. The variables are read once when the option is applied.
+func IncludeK8sMetadata(enabled bool) Option {
+	return func(o *options) { o.includeK8s = enabled }
+}
+
+// K8sEnvVars overrides the environment variables IncludeK8sMetadata reads.
+func K8sEnvVars(pod, namespace, node string) Option {
+	return func(o *options) {
+		o.k8sEnv = map[string]string{"k8s_pod": pod, "k8s_namespace": namespace, "k8s_node": node}
+	}
+}
+
+// ErrorEndpoint sends immediate error events (and FlushErrors) to url instead
+// of the main endpoint. Auth is unchanged.
+func ErrorEndpoint(url string) Option {
+	return func(o *options) { o.errorEndpoint = url }
+}
+
+// SampleRate keeps roughly r (0 to 1) of the records below ERROR that reach
+// a Handler. Errors are always kept. Defaults to 1, keeping everything.
+func SampleRate(r float64) Option {
+	return func(o *options) { o.sampled, o.sampleRate = true, r }
+}
+
+// SampleSeed makes sampling decisions reproducible: Senders with the same
+// seed keep and drop the same records of the same sequence. By default each
+// process draws from a randomly seeded generator.
+func SampleSeed(seed int64) Option {
+	return func(o *options) { o.sampleSeeded, o.sampleSeed = true, seed }
+}
+
+// SampleMode chooses how SampleRate picks the records it keeps.
+type SampleMode int
+
+const (
+	SampleRandom SampleMode = iota // each record independently, the default
+	KeepFirst                      // the first of each message always, then at random
+)
+
+// WithSampleMode sets the SampleRate mode. KeepFirst remembers the most recent
+// seenMessagesLimit distinct messages, so a message evicted from that set
+// counts as new again.
+func WithSampleMode(m SampleMode) Option {
+	return func(o *options) { o.sampleMode = m }
+}
+
+// seenMessagesLimit bounds the messages KeepFirst remembers.
+const seenMessagesLimit = 4096
+
+// messageLRU is the bounded set of messages KeepFirst has seen.
+type messageLRU struct {
+	mu    sync.Mutex
+	order *list.List // front is most recent
+	index map[string]*list.Element
+}
+
+// firstSeen records message and reports whether it was not already present.
+func (l *messageLRU) firstSeen(message string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.order == nil {
+		l.order, l.index = list.New(), make(map[string]*list.Element)
+	}
+	if el, ok := l.index[message]; ok {
+		l.order.MoveToFront(el)
+		return false
+	}
+	l.index[message] = l.order.PushFront(message)
+	if l.order.Len() > seenMessagesLimit {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.index, oldest.Value.(string))
+	}
+	return true
+}
+
+// MaxBufferSize caps how many events are buffered. When full, the oldest
+// non-error event is dropped to make room. Zero means no cap.
+func MaxBufferSize(n int) Option {
+	return func(o *options) { o.maxBufferSize = n }
+}
+
+// BlockOnFull makes logging wait up to d for a flush to free room when the
+// buffer is at MaxBufferSize, before falling back to dropping the oldest
+// event. It trades producer latency for fewer drops.
+func BlockOnFull(d time.Duration) Option {
+	return func(o *options) { o.blockOnFull = d }
+}
+
+// MinBatchSize defers a timed flush by another flush interval, up to
+// maxDeferrals times (default 1), while fewer than n events are buffered, so
+// quiet periods send fewer tiny batches. A buffered error event, a full batch,
+// or an explicit flush still sends at once. Zero disables it.
+func MinBatchSize(n, maxDeferrals int) Option {
+	return func(o *options) { o.minBatchSize, o.maxDeferrals = n, maxDeferrals }
+}
+
+// SoftBufferSize starts an immediate flush once n events are buffered, ahead
+// of the timer, while MaxBufferSize still decides when events are dropped.
+// It shares the single background flush with BatchSize. Zero disables it.
+func SoftBufferSize(n int) Option {
+	return func(o *options) { o.softBufferSize = n }
+}
+
+// OverflowWriter receives each event dropped by MaxBufferSize as a line of
+// JSON, leaving a paper trail instead of losing it silently.
+func OverflowWriter(w io.Writer) Option {
+	return func(o *options) { o.overflowWriter = w }
+}
+
+// IncludeBatchCounts adds the number of events per lowercased level to the
+// batch-level "meta" object as "counts", e.g. {"error": 2, "info": 8}, so the
+// server can summarize a batch without scanning its events.
+func IncludeBatchCounts(enabled bool) Option {
+	return func(o *options) { o.includeCounts = enabled }
+}
+
+// IncludeBuildInfo adds a batch-level "meta" object with the Go version and
+// VCS build info of the running binary.
+func IncludeBuildInfo(enabled bool) Option {
+	return func(o *options) { o.includeBuildInfo = enabled }
+}
+
+// HTTPClient sets the client used to send batches. It overrides the
+// connection pool options below.
+func HTTPClient(c *http.Client) Option {
+	return func(o *options) { o.client = c }
+}
+
+// MaxIdleConns caps idle keep-alive connections kept for reuse.
+func MaxIdleConns(n int) Option {
+	return func(o *options) { o.maxIdleConns = n }
+}
+
+// MaxConnsPerHost caps concurrent connections to the endpoint.
+func MaxConnsPerHost(n int) Option {
+	return func(o *options) { o.maxConnsPerHost = n }
+}
+
+// UseHTTP2 makes batches share one multiplexed HTTP/2 connection over TLS,
+// with health-check pings, when enabled, and limits sends to HTTP/1.1 when
+// disabled. Left unset, Go's default negotiation applies. An HTTPClient
+// option takes precedence.
+func UseHTTP2(enabled bool) Option {
+	return func(o *options) { o.http2Set, o.http2 = true, enabled }
+}
+
+// GlobalMaxConcurrency caps the requests a Sender has in flight at once,
+// across all of its handlers, flushes, and error sends. Sends past the cap
+// wait for a slot. Zero means no cap.
+func GlobalMaxConcurrency(n int) Option {
+	return func(o *options) { o.maxConcurrency = n }
+}
+
+// IdleConnTimeout sets how long an idle connection is kept before closing.
+func IdleConnTimeout(d time.Duration) Option {
+	return func(o *options) { o.idleConnTimeout = d }
+}
+
+// APIKeyFile reads the API key from the file at path when the Sender is
+// created, e.g. a mounted Kubernetes secret, instead of taking it as a
+// string. Surrounding whitespace is trimmed. If the file can't be read the
+// key passed to NewSender is kept and the error goes to OnError.
+func APIKeyFile(path string) Option {
+	return func(o *options) { o.apiKeyFile = path }
+}
+
+// APIKeyFunc fetches the API key before every request, for secrets that
+// rotate. It takes precedence over APIKeyFile and SetAPIKey. When it fails the
+// request is not sent and the events are handled like a transport failure.
+func APIKeyFunc(fn func() (string, error)) Option {
+	return func(o *options) { o.apiKeyFunc = fn }
+}
+
+// keyFromFile returns the key in APIKeyFile, or key when none is set or the
+// file can't be read.
+func keyFromFile(key string, o options) string {
+	if o.apiKeyFile == "" {
+		return key
+	}
+	b, err := os.ReadFile(o.apiKeyFile)
+	if err != nil {
+		if o.onError != nil {
+			o.onError(fmt.Errorf("lognorth: reading API key file: %w", err))
+		}
+		return key
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// SigningSecret makes every request carry an X-Signature header holding the
+// hex HMAC-SHA256 of the body under secret, for gateways that verify bodies
+// instead of bearer tokens.
+func SigningSecret(secret []byte) Option {
+	return func(o *options) { o.signingSecret = secret }
+}
+
+// TLSConfig sets the TLS configuration of the outbound transport, e.g. to
+// trust a private CA. TLSMinVersion and CipherSuites override its fields.
+func TLSConfig(cfg *tls.Config) Option {
+	return func(o *options) { o.tlsConfig = cfg }
+}
+
+// TLSMinVersion sets the lowest TLS version the client accepts, such as
+// tls.VersionTLS13. Go's default, and so ours, is TLS 1.2.
+func TLSMinVersion(v uint16) Option {
+	return func(o *options) { o.tlsMinVersion = v }
+}
+
+// CipherSuites restricts the TLS 1.0–1.2 cipher suites the client offers.
+// TLS 1.3 suites are not configurable in Go.
+func CipherSuites(ids ...uint16) Option {
+	return func(o *options) { o.cipherSuites = ids }
+}
+
+// MaxEventAge drops events older than d at send time instead of delivering
+// them, e.g. after a long outage. Dropped events are counted in Stats.Expired.
+func MaxEventAge(d time.Duration) Option {
+	return func(o *options) { o.maxEventAge = d }
+}
+
+// routePattern returns the ServeMux pattern that matched a request, without
+// its method ("GET /users/{id}" becomes "/users/{id}"), or "" if none did.
+func routePattern(pattern string) string {
+	if _, rest, ok := strings.Cut(pattern, " "); ok {
+		return strings.TrimLeft(rest, " \t")
+	}
+	return pattern
+}
+
+// PathNormalizer sets how Middleware reports request paths, e.g. collapsing
+// "/users/123" to "/users/:id" to keep cardinality down. Defaults to the raw
+// URL path.
+func PathNormalizer(fn func(r *http.Request) string) Option {
+	return func(o *options) { o.pathNormalizer = fn }
+}
+
+// RecoverPanics makes Middleware swallow panics from downstream handlers after
+// logging them. By default the panic is logged and then re-raised.
+func RecoverPanics(enabled bool) Option {
+	return func(o *options) { o.recoverPanics = enabled }
+}
+
+// TraceHeader sets the header Middleware reads the incoming trace ID from and
+// echoes it back in, e.g. "X-Request-ID". Defaults to "X-Trace-ID".
+func TraceHeader(name string) Option {
+	return func(o *options) { o.traceHeader = name }
+}
+
+// TraceIDGenerator sets how Middleware creates a trace ID when the request
+// carries none, e.g. to issue ULIDs or UUIDv7s. Defaults to 16 random hex
+// characters.
+func TraceIDGenerator(fn func() string) Option {
+	return func(o *options) { o.traceIDGen = fn }
+}
+
+// RequestIDFromContext lets Middleware reuse a request ID another middleware
+// (chi, gin) already stored in the request context. It is consulted when the
+// request carries no trace header, before a new ID is generated; an empty
+// result falls through to TraceIDGenerator.
+func RequestIDFromContext(fn func(ctx context.Context) string) Option {
+	return func(o *options) { o.requestID = fn }
+}
+
+// SlowRequestThreshold makes Middleware log requests slower than d at WARN
+// with slow: true in context, whatever their status.
+func SlowRequestThreshold(d time.Duration) Option {
+	return func(o *options) { o.slowRequestThreshold = d }
+}
+
+// LatencyBuckets makes Middleware add a latency_bucket label such as
+// "100ms-250ms" next to duration_ms, for cheap histograms. bounds need not be
+// sorted; requests outside them get "<first" or ">=last".
+func LatencyBuckets(bounds ...time.Duration) Option {
+	sorted := slices.Clone(bounds)
+	slices.Sort(sorted)
+	return func(o *options) { o.latencyBuckets = sorted }
+}
+
+// latencyBucket returns the label of the bucket d falls into. bounds are
+// sorted and non-empty; each bucket includes its lower bound.
+func latencyBucket(bounds []time.Duration, d time.Duration) string {
+	i, found := slices.BinarySearch(bounds, d)
+	if found {
+		i++
+	}
+	switch i {
+	case 0:
+		return "<" + bounds[0].String()
+	case len(bounds):
+		return ">=" + bounds[i-1].String()
+	}
+	return bounds[i-1].String() + "-" + bounds[i].String()
+}
+
+// CaptureHeaders makes Middleware attach the named request headers under a
+// "headers" context object. Only listed headers are captured; list
+// Authorization or cookies only if you redact them, e.g. in BeforeSend.
+func CaptureHeaders(names ...string) Option {
+	return func(o *options) { o.captureHeaders = names }
+}
+
+// CaptureQueryParams makes Middleware attach the named query parameters under
+// a "query" context object. Unlisted parameters, which may carry tokens, are
+// left out.
+func CaptureQueryParams(names ...string) Option {
+	return func(o *options) { o.captureQueryParams = names }
+}
+
+// TrustProxyHeaders makes Middleware take client_ip from X-Forwarded-For (its
+// leftmost address) or X-Real-IP instead of r.RemoteAddr. Enable it only
+// behind a proxy that sets these headers, since clients can forge them.
+func TrustProxyHeaders(trust bool) Option {
+	return func(o *options) { o.trustProxyHeaders = trust }
+}
+
+// clientIP returns the client address of r, from the forwarded headers when
+// trusted and valid, otherwise from RemoteAddr.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			if ip, err := netip.ParseAddr(strings.TrimSpace(first)); err == nil {
+				return ip.String()
+			}
+		}
+		if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return ip.String()
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// LogRequestStart makes Middleware also log a "started" event when a request
+// arrives, carrying the same trace_id as the completion event, so long-lived
+// requests such as SSE streams show up before they end.
+func LogRequestStart(enabled bool) Option {
+	return func(o *options) { o.logStart = enabled }
+}
+
+// SkipPaths makes Middleware skip the access log for requests whose
+// r.URL.Path exactly matches one of paths, e.g. "/healthz".
+func SkipPaths(paths ...string) Option {
+	return func(o *options) { o.skipPaths = paths }
+}
+
+// TraceExtractor sets a function that reads trace and span IDs from the
+// context passed to Handle, e.g. an active OpenTelemetry span. A non-empty
+// trace ID from fn takes precedence over the one set by Middleware. See the
+// lognorthotel module for a ready-made extractor.
+func TraceExtractor(fn func(ctx context.Context) (traceID, spanID string)) Option {
+	return func(o *options) { o.traceExtractor = fn }
+}
+
+// ContextExtractor adds a function that derives attrs (tenant, user, feature
+// flags) from the context passed to Handle. Extractors run in the order they
+// were added, after handler attrs and before record attrs, so later ones
+// override earlier keys.
+func ContextExtractor(fn func(ctx context.Context) []slog.Attr) Option {
+	return func(o *options) { o.contextExtractors = append(o.contextExtractors, fn) }
+}
+
+// LevelFields adds attrs to records at or above a level, keyed by that
+// threshold, e.g. build and host details only on errors:
+//
+//	LevelFields(map[slog.Level][]slog.Attr{slog.LevelError: {slog.String("build", sha)}})
+//
+// They follow handler attrs and come before ContextExtractor results, lower
+// thresholds first.
+func LevelFields(fields map[slog.Level][]slog.Attr) Option {
+	return func(o *options) { o.levelFields = fields }
+}
+
+// contextKeys is the process-wide registry behind RegisterContextKey.
+var contextKeys struct {
+	sync.RWMutex
+	keys   []any
+	fields []string
+}
+
+// RegisterContextKey makes every Handler promote the value stored under key
+// in the Handle context to the event field fieldName, so instrumentation that
+// puts values on the context needs no extractor at each call site. Values are
+// added after handler attrs and before ContextExtractor results. Registering
+// a key again changes its field name. It is safe for concurrent use.
+func RegisterContextKey(key any, fieldName string) {
+	contextKeys.Lock()
+	defer contextKeys.Unlock()
+	if i := slices.Index(contextKeys.keys, key); i >= 0 {
+		contextKeys.fields[i] = fieldName
+		return
+	}
+	contextKeys.keys = append(contextKeys.keys, key)
+	contextKeys.fields = append(contextKeys.fields, fieldName)
+}
+
+// registeredAttrs returns the registered context values present in ctx.
+func registeredAttrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	contextKeys.RLock()
+	defer contextKeys.RUnlock()
+	var attrs []slog.Attr
+	for i, key := range contextKeys.keys {
+		if v := ctx.Value(key); v != nil {
+			attrs = append(attrs, slog.Any(contextKeys.fields[i], v))
+		}
+	}
+	return attrs
+}
+
+// SendMinLevel makes Handle accept but not send records below l. Enabled
+// still reports true, so tees and wrapping handlers see every record while
+// only l and above reach LogNorth.
+func SendMinLevel(l slog.Level) Option {
+	return func(o *options) { o.sendMinSet, o.sendMinLevel = true, l }
+}
+
+// MaxAttrs caps the attrs kept per event, counting handler attrs first and
+// each group as one. Extra attrs are dropped and attrs_truncated: true is set
+// in context. Zero means no cap.
+func MaxAttrs(n int) Option {
+	return func(o *options) { o.maxAttrs = n }
+}
+
+// DefaultZeroTimeToNow controls the timestamp of slog records with a zero
+// Time. Enabled by default, they are stamped with the current time; disabled,
+// they keep 0001-01-01T00:00:00Z. Other records carry their own Time.
+func DefaultZeroTimeToNow(enabled bool) Option {
+	return func(o *options) { o.keepZeroTime = !enabled }
+}
+
+// MaxStringLen cuts string attrs, error strings including each error_chain
+// message, and the message of slog records to n bytes, appending
+// "…[truncated N bytes]" with the number of bytes removed. Zero means no
+// limit.
+func MaxStringLen(n int) Option {
+	return func(o *options) { o.maxStringLen = n }
+}
+
+// StringifyContext turns every context value into a string, with attr groups
+// flattened to dotted keys ("http.status"), for backends that index a flat
+// string map. Numbers use the shortest exact form, times RFC 3339 in UTC,
+// durations Go syntax ("1.5s"), and other values their JSON encoding.
+func StringifyContext(enabled bool) Option {
+	return func(o *options) { o.stringifyContext = enabled }
+}
+
+// flattenStrings copies m into dst as strings, prefixing keys of nested maps
+// with their parent key.
+func flattenStrings(dst map[string]any, prefix string, m map[string]any) {
+	for k, v := range m {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]any); ok {
+			flattenStrings(dst, k, nested)
+			continue
+		}
+		dst[k] = stringValue(v)
+	}
+}
+
+// stringValue formats v deterministically for StringifyContext.
+func stringValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	if b, err := json.Marshal(v); err == nil {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// TemplateKey lifts the string attr named key, e.g. "msg_template", out of
+// context into the top-level template field, so the server can group events
+// whose messages differ only in their parameters.
+func TemplateKey(key string) Option {
+	return func(o *options) { o.templateKey = key }
+}
+
+// CorrelationKey names the attr lifted out of context into the top-level
+// correlation_id field. The default is "correlation_id"; non-string values
+// are formatted with fmt.Sprint.
+func CorrelationKey(key string) Option {
+	return func(o *options) { o.correlationKey = key }
+}
+
+// KeyResolver routes each event handled with a context to a destination, e.g.
+// a per-tenant LogNorth project. Events are grouped per destination at send
+// time. An empty apiKey or endpoint falls back to the Sender's own.
+func KeyResolver(fn func(ctx context.Context) (apiKey, endpoint string)) Option {
+	return func(o *options) { o.keyResolver = fn }
+}
+
+// Config sets the endpoint, API key, and options. Call once at startup.
+func Config(url, key string, opts ...Option) {
+	o := newOptions(opts)
+	key = keyFromFile(key, o)
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.endpoint = url
+	std.apiKey = key
+	std.opts = o
+	std.client = nil
+	std.sem = nil
+	std.rngMu.Lock()
+	std.rng = nil
+	std.rngMu.Unlock()
+	std.stopHeartbeat()
+	std.startHeartbeat()
+}
+
+// startHeartbeat starts the HeartbeatInterval goroutine, if configured.
+// Callers hold s.mu.
+func (s *Sender) startHeartbeat() {
+	d := s.opts.heartbeat
+	if d <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	s.beatStop = stop
+	tick := s.beatTick
+	s.beats.Go(func() {
+		if tick == nil {
+			ticker := time.NewTicker(d)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick:
+				s.logEvent(Event{Message: "heartbeat"})
+				s.flushAsync()
+			}
+		}
+	})
+}
+
+// stopHeartbeat signals the heartbeat goroutine to exit. Callers hold s.mu.
+func (s *Sender) stopHeartbeat() {
+	if s.beatStop != nil {
+		close(s.beatStop)
+		s.beatStop = nil
+	}
+}
+
+// Close stops the default Sender's heartbeat and flushes its buffer.
+func Close() error {
+	return std.Close()
+}
+
+// Close stops the heartbeat, sends everything buffered, and waits for
+// background sends to finish. Logging after Close still buffers events.
+func (s *Sender) Close() error {
+	s.mu.Lock()
+	s.stopHeartbeat()
+	s.mu.Unlock()
+	s.beats.Wait()
+	err := s.FlushContext(context.Background())
+	s.Wait()
+	return err
+}
+
+// Log sends a regular log message. Batched automatically.
+func Log(message string, ctx map[string]any) {
+	std.logEvent(Event{Message: message, Context: ctx})
+}
+
+// Log sends a regular log message through s. Batched automatically.
+func (s *Sender) Log(message string, ctx map[string]any) {
+	s.logEvent(Event{Message: message, Context: ctx})
+}
+
+// logEvent stamps e and buffers it. Level defaults to INFO.
+func (s *Sender) logEvent(e Event) {
+	if e.Level == "" {
+		e.Level = s.options().levelName(slog.LevelInfo)
+	}
+	s.stamp(&e)
+	s.enqueue(e)
+}
+
+// fanOut offers e, once it has its ID and was accepted for delivery, to the
+// EventSink channel without blocking.
+func (s *Sender) fanOut(e Event) {
+	ch := s.options().eventSink
+	if ch == nil {
+		return
+	}
+	e.Context = cloneContext(e.Context)
+	select {
+	case ch <- e:
+	default:
+	}
+}
+
+// stamp sets the event timestamp and the fields added to every event.
+func (s *Sender) stamp(e *Event) {
+	if e.Timestamp == "" {
+		e.Timestamp = s.timeNow().UTC().Format(time.RFC3339)
+	}
+	opts := s.options()
+	if fields := opts.k8sFields; len(fields) > 0 {
+		if e.Context == nil {
+			e.Context = make(map[string]any, len(fields))
+		}
+		for k, v := range fields {
+			if _, ok := e.Context[k]; !ok {
+				e.Context[k] = v
+			}
+		}
+	}
+	if opts.stringifyContext && len(e.Context) > 0 {
+		flat := make(map[string]any, len(e.Context))
+		flattenStrings(flat, "", e.Context)
+		e.Context = flat
+	}
+}
+
+func (s *Sender) enqueue(e Event) {
+	if e.ID == "" {
+		e.ID = s.eventID(e)
+	}
+	s.mu.Lock()
+	if limit := s.opts.maxBufferSize; limit > 0 && len(s.buffer) >= limit {
+		if d := s.opts.blockOnFull; d > 0 {
+			s.waitForSpace(limit, d)
+		}
+		if len(s.buffer) >= limit {
+			s.evictOldest()
+		}
+	}
+	e.queued = s.timeNow()
+	flushBytes := s.opts.flushBytes
+	if flushBytes > 0 {
+		b, _ := s.opts.marshal(e)
+		e.size = len(b)
+	}
+	s.buffer = append(s.buffer, e)
+	s.bytes += e.size
+	n, size := len(s.buffer), s.bytes
+	if s.timer == nil {
+		s.armTimer()
+	}
+	batchSize, soft := s.batchSize(), s.opts.softBufferSize
+	s.mu.Unlock()
+	s.fanOut(e)
+
+	if n >= batchSize || (flushBytes > 0 && size >= flushBytes) || (soft > 0 && n >= soft) {
+		s.flushAsync()
+	}
+}
+
+// flushAsync starts a background flush unless one is already pending, so a
+// burst of logs past the batch size shares one flush instead of spawning a
+// goroutine per event.
+func (s *Sender) flushAsync() {
+	if !s.flushing.CompareAndSwap(false, true) {
+		return
+	}
+	s.inflight.Go(func() {
+		err := s.autoFlush()
+		s.flushing.Store(false)
+		// Events that crossed the batch size while the flag was set found the
+		// flush already taken; pick them up now rather than at the timer.
+		s.mu.Lock()
+		full := s.ready(s.timeNow()) >= s.batchSize()
+		s.mu.Unlock()
+		if err == nil && full {
+			s.flushAsync()
+		}
+	})
+}
+
+// waitForSpace blocks until the buffer is below limit or d has passed.
+// Callers hold s.mu.
+func (s *Sender) waitForSpace(limit int, d time.Duration) {
+	if s.space == nil {
+		s.space = sync.NewCond(&s.mu)
+	}
+	timedOut := false
+	timer := time.AfterFunc(d, func() {
+		s.mu.Lock()
+		timedOut = true
+		s.space.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+	for len(s.buffer) >= limit && !timedOut {
+		s.space.Wait()
+	}
+}
+
+// signalSpace wakes producers waiting in BlockOnFull. Callers hold s.mu.
+func (s *Sender) signalSpace() {
+	if s.space != nil {
+		s.space.Broadcast()
+	}
+}
+
+// evictOldest drops the oldest non-error event (or the oldest event when all
+// are errors) to make room, writing it to OverflowWriter first if one is set.
+// Callers hold s.mu.
+func (s *Sender) evictOldest() {
+	i := 0
+	for j, e := range s.buffer {
+		if !isErrorEvent(e) {
+			i = j
+			break
+		}
+	}
+	dropped := s.buffer[i]
+	s.buffer = append(s.buffer[:i], s.buffer[i+1:]...)
+	s.bytes -= dropped.size
+	s.dropped.Add(1)
+	if w := s.opts.overflowWriter; w != nil {
+		b, _ := s.opts.marshal(dropped)
+		w.Write(append(b, '\n'))
+	}
+}
+
+// requeue puts events back at the front of the buffer after a failed
+// attempt, holding them off timed flushes for RetryDelay. Replayed events are
+// skipped: their spool position is not advanced, so the next Replay sends
+// them again.
+func (s *Sender) requeue(events []Event) {
+	s.putBack(events, func(e *Event, now time.Time) {
+		e.tries++
+		e.retry = now.Add(s.opts.retryWait(e.tries))
+	})
+}
+
+// hold puts events the retry budget kept off the wire back at the front of
+// the buffer until the next token is due. They never reached the server, so
+// the attempt does not count against their retry limits.
+func (s *Sender) hold(events []Event, until time.Time) {
+	s.putBack(events, func(e *Event, _ time.Time) { e.retry = until })
+}
+
+// putBack returns events, updated under s.mu, to the front of the buffer,
+// skipping replayed ones.
+func (s *Sender) putBack(events []Event, update func(e *Event, now time.Time)) {
+	events = slices.DeleteFunc(slices.Clone(events), func(e Event) bool { return e.replay })
+	if len(events) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.timeNow()
+	for i := range events {
+		update(&events[i], now)
+		s.bytes += events[i].size
+	}
+	s.buffer = append(events, s.buffer...)
+	s.armTimer()
+}
+
+// takeRetry spends one token from the retry budget, refilling it at
+// RetryBudgetPerSecond up to one second's worth (at least one token). It
+// reports false when the budget is spent, with the time the next token is
+// due.
+func (s *Sender) takeRetry() (next time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rate := s.opts.retryBudget
+	if rate <= 0 {
+		return time.Time{}, true
+	}
+	now, burst := s.timeNow(), max(rate, 1)
+	if s.refilled.IsZero() {
+		s.tokens = burst
+	} else {
+		s.tokens = min(burst, s.tokens+now.Sub(s.refilled).Seconds()*rate)
+	}
+	s.refilled = now
+	if s.tokens < 1 {
+		return now.Add(time.Duration((1 - s.tokens) / rate * float64(time.Second))), false
+	}
+	s.tokens--
+	return time.Time{}, true
+}
+
+// armTimer schedules the next timed flush for when the oldest buffered event
+// has waited a full flush interval, so partial flushes never stretch an
+// event's latency, or for the next FlushAt boundary. A requeued event is not
+// due before its retry delay ends. It never fires before a 429 backoff ends.
+// Callers hold s.mu.
+func (s *Sender) armTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.buffer) == 0 {
+		return
+	}
+	now := s.timeNow()
+	if align := s.opts.flushAt; align > 0 {
+		s.deadline = now.Truncate(align).Add(align)
+	} else {
+		wait := s.flushInterval() * time.Duration(1+s.deferred)
+		s.deadline = time.Time{}
+		for _, e := range s.buffer {
+			// Error events requeued straight from a send were never queued.
+			due := e.retry
+			if due.IsZero() || !e.queued.IsZero() {
+				queued := e.queued
+				if queued.IsZero() || queued.After(now) {
+					queued = now
+				}
+				if queued.Add(wait).After(due) {
+					due = queued.Add(wait)
+				}
+			}
+			if s.deadline.IsZero() || due.Before(s.deadline) {
+				s.deadline = due
+			}
+		}
+	}
+	if s.deadline.Before(s.backoff) {
+		s.deadline = s.backoff
+	}
+	s.timer = time.AfterFunc(max(s.deadline.Sub(now), 0), s.timedFlush)
+}
+
+// timedFlush runs when the flush timer fires. Under MinBatchSize it rearms
+// the timer one interval later instead while the buffer is short and holds no
+// error events.
+func (s *Sender) timedFlush() {
+	s.mu.Lock()
+	if n := s.opts.minBatchSize; n > 0 && len(s.buffer) < n &&
+		s.deferred < cmp.Or(s.opts.maxDeferrals, defaultMaxDeferrals) &&
+		!slices.ContainsFunc(s.buffer, isErrorEvent) {
+		s.deferred++
+		s.armTimer()
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	s.autoFlush()
+}
+
+// autoFlush flushes on behalf of the timer or a batch-size trigger, bounded
+// by FlushTimeout.
+func (s *Sender) autoFlush() error {
+	ctx := context.Background()
+	if d := s.options().flushTimeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, d, errFlushTimeout)
+		defer cancel()
+	}
+	return s.flush(ctx, true)
+}
+
+// ready counts the buffered events a timed flush may send at now: all but
+// those still waiting out a retry delay. Callers hold s.mu.
+func (s *Sender) ready(now time.Time) int {
+	n := 0
+	for _, e := range s.buffer {
+		if !e.retry.After(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// batchSize returns the configured batch size. Callers hold s.mu.
+func (s *Sender) batchSize() int {
+	if s.opts.batchSize > 0 {
+		return s.opts.batchSize
+	}
+	return defaultBatchSize
+}
+
+// nextBatch removes and returns up to limit events from the front of the
+// buffer, capped by BatchSize and MaxBatchBytes. A timed batch skips events
+// still waiting out a retry delay. It always takes at least one event so an
+// oversized event can't wedge the buffer. Callers hold s.mu.
+func (s *Sender) nextBatch(limit int, timed bool) []Event {
+	n, maxBytes := min(limit, s.batchSize()), s.opts.maxBatchBytes
+	now := s.timeNow()
+	var batch []Event
+	rest := make([]Event, 0, len(s.buffer))
+	size, full := 0, false
+	for _, e := range s.buffer {
+		if full || len(batch) == n || timed && e.retry.After(now) {
+			rest = append(rest, e)
+			continue
+		}
+		if maxBytes > 0 {
+			b, _ := s.opts.marshal(e)
+			if size += len(b) + 1; size > maxBytes && len(batch) > 0 {
+				full = true
+				rest = append(rest, e)
+				continue
+			}
+		}
+		batch = append(batch, e)
+	}
+	s.buffer = rest
+	for _, e := range batch {
+		s.bytes -= e.size
+	}
+	s.signalSpace()
+	return batch
+}
+
+// Error sends an error log immediately.
+func Error(message string, err error, ctx map[string]any) {
+	std.errorEvent(Event{Message: message, Context: ctx}, err, 2)
+}
+
+// Error sends an error log through s immediately.
+func (s *Sender) Error(message string, err error, ctx map[string]any) {
+	s.errorEvent(Event{Message: message, Context: ctx}, err, 2)
+}
+
+// errorEvent adds the structured error fields to e and sends it right away,
+// or buffers it under BufferErrors.
+func (s *Sender) errorEvent(e Event, err error, callerSkip int) {
+	if e.Context == nil {
+		e.Context = make(map[string]any)
+	}
+	ctx := e.Context
+	maxLen := s.options().maxStringLen
+	ctx["error"] = truncateString(err.Error(), maxLen)
+
+	errorClass := "error"
+	if err != nil {
+		errorClass = typeName(err)
+	}
+	ctx["error_class"] = errorClass
+
+	// Walk the %w chain so causes and their types survive wrapping. The
+	// deepest layer that isn't a plain errors.New/fmt.Errorf value names the
+	// error_type.
+	var chain []map[string]any
+	errorType := errorClass
+	for layer := err; layer != nil; layer = errors.Unwrap(layer) {
+		name := typeName(layer)
+		chain = append(chain, map[string]any{"message": truncateString(layer.Error(), maxLen), "type": name})
+		if !plainErrorTypes[name] {
+			errorType = name
+		}
+	}
+	if len(chain) > 1 {
+		ctx["error_chain"] = chain
+	}
+	ctx["error_type"] = errorType
+
+	if pc, file, line, ok := runtime.Caller(callerSkip); ok {
+		ctx["error_file"] = filepath.Base(file)
+		ctx["error_line"] = line
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			parts := strings.Split(fn.Name(), ".")
+			ctx["error_caller"] = parts[len(parts)-1]
+			ctx["error_function"] = fn.Name()
+		}
+	}
+
+	buf := make([]byte, 4096)
+	n := runtime.Stack(buf, false)
+	ctx["stack_trace"] = string(buf[:n])
+
+	e.Level = s.options().levelName(slog.LevelError)
+	s.stamp(&e)
+
+	if s.options().bufferErrors {
+		s.enqueue(e)
+		return
+	}
+	e.ID = s.eventID(e)
+	s.mu.Lock()
+	s.errQueue = append(s.errQueue, e)
+	start := !s.errWorker
+	s.errWorker = true
+	s.mu.Unlock()
+	s.fanOut(e)
+	if start {
+		s.inflight.Go(s.drainErrors)
+	}
+}
+
+// drainErrors is the single error worker: it sends queued errors, batching
+// any that arrived meanwhile, until the queue is empty.
+func (s *Sender) drainErrors() {
+	for {
+		s.mu.Lock()
+		errs := s.errQueue
+		s.errQueue = nil
+		if len(errs) == 0 {
+			s.errWorker = false
+			s.mu.Unlock()
+			return
+		}
+		timeout := cmp.Or(s.opts.errorTimeout, defaultErrorSendTimeout)
+		s.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		s.send(ctx, errs, true)
+		cancel()
+	}
+}
+
+// sendQueuedErrors sends errors still waiting for the worker, so a flush
+// delivers them ahead of its own batches.
+func (s *Sender) sendQueuedErrors(ctx context.Context) {
+	s.mu.Lock()
+	errs := s.errQueue
+	s.errQueue = nil
+	s.mu.Unlock()
+	if len(errs) > 0 {
+		s.send(ctx, errs, true)
+	}
+}
+
+// plainErrorTypes are the stdlib error types that carry no meaning of their own.
+var plainErrorTypes = map[string]bool{
+	"errors.errorString": true,
+	"fmt.wrapError":      true,
+	"fmt.wrapErrors":     true,
+}
+
+func typeName(v any) string {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return ""
+	}
+	return strings.TrimPrefix(t.String(), "*")
+}
+
+// Flush sends all buffered events.
+func Flush() {
+	std.Flush()
+}
+
+// FlushN sends all buffered events like Flush and returns how many were
+// delivered, with the first send error.
+func FlushN() (int, error) {
+	return std.FlushN()
+}
+
+// Wait blocks until all background sends of the default Sender have finished.
+func Wait() {
+	std.Wait()
+}
+
+// Wait blocks until every send s started in the background (immediate error
+// sends, batch-size flushes, recovery drains) has finished. Timer flushes are
+// not included.
+func (s *Sender) Wait() {
+	s.inflight.Wait()
+}
+
+// FlushN flushes s synchronously and returns how many events the server
+// accepted, so partial failures can be told from full ones. Events sent by
+// concurrent background flushes are not counted.
+func (s *Sender) FlushN() (int, error) {
+	var n atomic.Int64
+	err := s.FlushContext(context.WithValue(context.Background(), deliveredKey, &n))
+	return int(n.Load()), err
+}
+
+// Flush sends all events buffered in s.
+func (s *Sender) Flush() {
+	s.FlushContext(context.Background())
+}
+
+// FlushContext sends all buffered events, giving up when ctx is done.
+func FlushContext(ctx context.Context) error {
+	return std.FlushContext(ctx)
+}
+
+// FlushContext sends all events buffered in s, giving up when ctx is done.
+func (s *Sender) FlushContext(ctx context.Context) error {
+	return s.flush(ctx, false)
+}
+
+// flush sends the buffered events. A timed flush leaves events still waiting
+// out a retry delay for a later one.
+func (s *Sender) flush(ctx context.Context, timed bool) error {
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.deferred = 0
+	pending := len(s.buffer)
+	if timed {
+		pending = s.ready(s.timeNow())
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		if s.timer == nil {
+			s.armTimer()
+		}
+		s.mu.Unlock()
+	}()
+
+	// Send in chunks, oldest first, letting queued errors jump ahead of each
+	// chunk. Unsent chunks stay in the buffer, so stopping on a failure keeps
+	// them queued in order.
+	for {
+		s.sendQueuedErrors(ctx)
+		if pending <= 0 {
+			return nil
+		}
+		s.mu.Lock()
+		batch := s.nextBatch(pending, timed)
+		s.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		pending -= len(batch)
+		if err := s.send(ctx, batch, false); err != nil {
+			return err
+		}
+	}
+}
+
+// FlushErrors sends only the buffered error events, leaving the rest buffered.
+func FlushErrors() {
+	std.FlushErrors()
+}
+
+// FlushErrors sends only the error events buffered in s, leaving the rest in
+// place. It is mostly useful together with BufferErrors.
+func (s *Sender) FlushErrors() {
+	s.mu.Lock()
+	var errs, rest []Event
+	for _, e := range s.buffer {
+		if isErrorEvent(e) {
+			errs = append(errs, e)
+			s.bytes -= e.size
+		} else {
+			rest = append(rest, e)
+		}
+	}
+	s.buffer = rest
+	s.signalSpace()
+	s.armTimer()
+	s.mu.Unlock()
+
+	s.send(context.Background(), errs, true)
+}
+
+func isErrorEvent(e Event) bool {
+	t, _ := e.Context["error_type"].(string)
+	return t != ""
+}
+
+// buildInfo is the batch-level metadata added by IncludeBuildInfo.
+var buildInfo = sync.OnceValue(func() map[string]any {
+	meta := map[string]any{"go_version": runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return meta
+	}
+	if info.Main.Path != "" {
+		meta["module"] = info.Main.Path
+		meta["module_version"] = info.Main.Version
+	}
+	for _, kv := range info.Settings {
+		switch kv.Key {
+		case "vcs", "vcs.revision", "vcs.time", "vcs.modified":
+			meta[strings.ReplaceAll(kv.Key, ".", "_")] = kv.Value
+		}
+	}
+	return meta
+})
+
+// batchMeta returns the batch-level metadata for events, or nil when none is
+// configured.
+func batchMeta(o options, events []Event) map[string]any {
+	var meta map[string]any
+	if o.includeBuildInfo {
+		meta = maps.Clone(buildInfo())
+	}
+	if o.includeCounts {
+		counts := make(map[string]any)
+		for _, e := range events {
+			level := strings.ToLower(cmp.Or(e.Level, "INFO"))
+			n, _ := counts[level].(int)
+			counts[level] = n + 1
+		}
+		if meta == nil {
+			meta = make(map[string]any)
+		}
+		meta["counts"] = counts
+	}
+	return meta
+}
+
+// protoBatch encodes events as a lognorth.v1.Batch message, with meta unless
+// it is nil. Context values become google.protobuf.Value the way
+// encoding/json would render them.
+func protoBatch(events []Event, meta map[string]any) ([]byte, error) {
+	var b []byte
+	for _, e := range events {
+		var msg []byte
+		msg = protoString(msg, 1, e.ID)
+		msg = protoString(msg, 2, e.Level)
+		msg = protoString(msg, 3, e.Message)
+		msg = protoString(msg, 4, e.Timestamp)
+		if e.DurationMS != 0 {
+			msg = protoTag(msg, 5, 0)
+			msg = binary.AppendUvarint(msg, uint64(e.DurationMS))
+		}
+		msg = protoString(msg, 6, e.TraceID)
+		msg = protoString(msg, 7, e.SpanID)
+		msg = protoString(msg, 8, e.Template)
+		msg = protoString(msg, 9, e.BatchID)
+		msg = protoString(msg, 11, e.CorrelationID)
+		if len(e.Context) > 0 {
+			st, err := protoStruct(e.Context)
+			if err != nil {
+				return nil, err
+			}
+			msg = protoBytes(msg, 10, st)
+		}
+		b = protoBytes(b, 1, msg)
+	}
+	if meta != nil {
+		st, err := protoStruct(meta)
+		if err != nil {
+			return nil, err
+		}
+		b = protoBytes(b, 2, st)
+	}
+	return b, nil
+}
+
+// protoStruct encodes m as a google.protobuf.Struct, keys sorted.
+func protoStruct(m map[string]any) ([]byte, error) {
+	var b []byte
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		v, err := protoValue(m[k])
+		if err != nil {
+			return nil, err
+		}
+		var entry []byte
+		entry = protoBytes(entry, 1, []byte(k))
+		entry = protoBytes(entry, 2, v)
+		b = protoBytes(b, 1, entry)
+	}
+	return b, nil
+}
+
+// protoValue encodes v as a google.protobuf.Value. Types other than the JSON
+// ones go through encoding/json first.
+func protoValue(v any) ([]byte, error) {
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		b = protoTag(b, 1, 0)
+		b = append(b, 0)
+	case string:
+		b = protoBytes(b, 3, []byte(v))
+	case bool:
+		b = protoTag(b, 4, 0)
+		if v {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	case float64:
+		b = protoTag(b, 2, 1)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	case int:
+		return protoValue(float64(v))
+	case int64:
+		return protoValue(float64(v))
+	case map[string]any:
+		st, err := protoStruct(v)
+		if err != nil {
+			return nil, err
+		}
+		b = protoBytes(b, 5, st)
+	case []any:
+		var list []byte
+		for _, item := range v {
+			iv, err := protoValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list = protoBytes(list, 1, iv)
+		}
+		b = protoBytes(b, 6, list)
+	default:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var generic any
+		if err := json.Unmarshal(raw, &generic); err != nil {
+			return nil, err
+		}
+		return protoValue(generic)
+	}
+	return b, nil
+}
+
+// protoTag appends a field key: the field number and wire type.
+func protoTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// protoBytes appends a length-delimited field.
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = protoTag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// protoString appends a string field, omitting it when empty as proto3 does.
+func protoString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return protoBytes(b, field, []byte(v))
+}
+
+// FailureClass classifies a failed send. It implements error so returned errors
+// can be matched with errors.Is(err, ErrServer) and friends.
+type FailureClass int
+
+const (
+	ErrTransport   FailureClass = iota + 1 // DNS, connection refused, timeout
+	ErrClient                              // 4xx other than 429
+	ErrServer                              // 5xx and other non-2xx statuses
+	ErrRateLimited                         // 429, or sends paused after one
+)
+
+func (c FailureClass) Error() string {
+	switch c {
+	case ErrTransport:
+		return "lognorth: transport error"
+	case ErrClient:
+		return "lognorth: client error"
+	case ErrServer:
+		return "lognorth: server error"
+	case ErrRateLimited:
+		return "lognorth: rate limited"
+	}
+	return "lognorth: unknown error"
+}
+
+// ErrRetryBudget is returned when a retry is skipped because the
+// RetryBudgetPerSecond budget is spent.
+var ErrRetryBudget = errors.New("lognorth: retry budget exhausted")
+
+// errBackoff is returned by send while the server has asked us to slow down.
+var errBackoff = fmt.Errorf("%w: backing off after 429", ErrRateLimited)
+
+func (s *Sender) send(ctx context.Context, events []Event, isError bool) error {
+	s.mu.Lock()
+	endpoint, apiKey, opts := s.endpoint, s.apiKey, s.opts
+	if isError && opts.errorEndpoint != "" {
+		endpoint = opts.errorEndpoint
+	}
+	if len(events) == 0 || (endpoint == "" && opts.keyResolver == nil && !opts.hasSink()) {
+		s.mu.Unlock()
+		s.writeFallback(events)
+		return nil
+	}
+	if s.timeNow().Before(s.backoff) && !(isError && opts.errorsBypass) {
+		s.mu.Unlock()
+		s.lose(events)
+		return errBackoff
+	}
+	s.mu.Unlock()
+
+	if opts.maxEventAge > 0 {
+		cutoff := s.timeNow().Add(-opts.maxEventAge)
+		fresh := events[:0:0]
+		for _, e := range events {
+			if t, err := time.Parse(time.RFC3339, e.Timestamp); err == nil && t.Before(cutoff) {
+				s.expired.Add(1)
+				continue
+			}
+			fresh = append(fresh, e)
+		}
+		events = fresh
+		if len(events) == 0 {
+			return nil
+		}
+	}
+
+	if opts.apiKeyFunc != nil {
+		key, err := opts.apiKeyFunc()
+		if err != nil {
+			err = fmt.Errorf("lognorth: fetching API key: %w", err)
+			return s.transportFailed(ctx, opts, err, events, isError)
+		}
+		apiKey = key
+	}
+
+	// Events resolved by KeyResolver go to their own destination; the rest
+	// use the Sender's endpoint and key.
+	var firstErr error
+	for _, g := range groupByDestination(events) {
+		url, key := endpoint, apiKey
+		if g.dest.endpoint != "" {
+			url = g.dest.endpoint
+		}
+		if g.dest.apiKey != "" {
+			key = g.dest.apiKey
+		}
+		if url == "" && !opts.hasSink() {
+			s.writeFallback(g.events)
+			continue
+		}
+		// A retryable failure outranks a final rejection, so Replay never
+		// skips past events that may still be delivered.
+		var rejected rejectedError
+		if err := s.post(ctx, opts, url, key, g.events, isError, 0); err != nil && (firstErr == nil || errors.As(firstErr, &rejected) && !errors.As(err, &rejected)) {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type destination struct {
+	apiKey, endpoint string
+}
+
+type destinationGroup struct {
+	dest   destination
+	events []Event
+}
+
+// groupByDestination splits events by resolved destination, keeping the order
+// of first appearance and the event order within each group.
+func groupByDestination(events []Event) []destinationGroup {
+	var groups []destinationGroup
+	index := make(map[destination]int)
+	for _, e := range events {
+		i, ok := index[e.dest]
+		if !ok {
+			i = len(groups)
+			index[e.dest] = i
+			groups = append(groups, destinationGroup{dest: e.dest})
+		}
+		groups[i].events = append(groups[i].events, e)
+	}
+	return groups
+}
+
+// acquire takes a request slot under GlobalMaxConcurrency, waiting until one
+// frees up or ctx is done. The returned release may be called more than once.
+func (s *Sender) acquire(ctx context.Context) (release func(), err error) {
+	s.mu.Lock()
+	if s.opts.maxConcurrency <= 0 {
+		s.mu.Unlock()
+		return func() {}, nil
+	}
+	if s.sem == nil {
+		s.sem = make(chan struct{}, s.opts.maxConcurrency)
+	}
+	sem := s.sem
+	s.mu.Unlock()
+	select {
+	case sem <- struct{}{}:
+		return sync.OnceFunc(func() { <-sem }), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// maxSplitDepth caps how many times a batch rejected with 413 is halved.
+const maxSplitDepth = 8
+
+// post sends one batch to endpoint and handles the response. depth counts
+// the 413 splits that led to this batch.
+func (s *Sender) post(ctx context.Context, opts options, endpoint, apiKey string, events []Event, isError bool, depth int) error {
+	// Events first sent here share a batch ID; retried events keep theirs.
+	if depth == 0 {
+		batchID := generateTraceID()
+		for i := range events {
+			if events[i].BatchID == "" {
+				events[i].BatchID = batchID
+			}
+		}
+	}
+
+	wire := opts.encoding
+	if opts.dryRun != nil || opts.hasSink() {
+		wire = JSON
+	}
+	// Binary-mode CloudEvents carry one event per request.
+	if wire == CloudEventsBinary && len(events) > 1 {
+		var firstErr error
+		for i := range events {
+			if err := s.post(ctx, opts, endpoint, apiKey, events[i:i+1:i+1], isError, depth+1); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	// events keeps the originals so retries re-run BeforeSend on unmodified
+	// input; payload holds what actually goes on the wire.
+	payload := events
+	if opts.beforeSend != nil {
+		payload = make([]Event, 0, len(events))
+		kept := make([]Event, 0, len(events))
+		for _, e := range events {
+			if out, ok := opts.beforeSend(e); ok {
+				payload = append(payload, out)
+				kept = append(kept, e)
+			}
+		}
+		events = kept
+		if len(payload) == 0 {
+			return nil
+		}
+	}
+	if opts.retryBudget > 0 && slices.ContainsFunc(events, func(e Event) bool { return e.tries > 0 }) {
+		if next, ok := s.takeRetry(); !ok {
+			s.hold(events, next)
+			return ErrRetryBudget
+		}
+	}
+	if opts.transport != nil {
+		release, err := s.acquire(ctx)
+		if err != nil {
+			return s.transportFailed(ctx, opts, err, events, isError)
+		}
+		err = opts.transport.Send(ctx, payload)
+		release()
+		var partial *PartialError
+		if errors.As(err, &partial) {
+			var sent, failed []Event
+			for i, e := range events {
+				if slices.Contains(partial.Failed, i) {
+					failed = append(failed, e)
+				} else {
+					sent = append(sent, e)
+				}
+			}
+			s.delivered(ctx, sent)
+			// Partial failures are mostly throttling, so like 207 rejects they
+			// are retried rather than lost.
+			err = fmt.Errorf("%w: %w", ErrTransport, err)
+			s.fail(err)
+			s.retryOrLose(failed)
+			return err
+		}
+		if err != nil {
+			return s.transportFailed(ctx, opts, err, events, isError)
+		}
+		s.delivered(ctx, events)
+		return nil
+	}
+
+	batch := map[string]any{"events": payload}
+	meta := batchMeta(opts, payload)
+	if meta != nil {
+		batch["meta"] = meta
+	}
+	contentType := "application/json"
+	var body []byte
+	var err error
+	switch wire {
+	case Protobuf:
+		contentType = "application/x-protobuf"
+		body, err = protoBatch(payload, meta)
+	case CloudEvents:
+		contentType = "application/cloudevents-batch+json"
+		body, err = opts.marshal(cloudEventBatch(opts, payload))
+	case CloudEventsBinary:
+		body, err = opts.marshal(payload[0])
+	default:
+		body, err = opts.marshal(batch)
+	}
+	if err != nil {
+		s.dropped.Add(uint64(len(events)))
+		return fmt.Errorf("lognorth: encoding batch: %w", err)
+	}
+	if opts.dryRun != nil {
+		_, err := fmt.Fprintf(opts.dryRun, "POST %s/api/v1/events/batch %s\n", endpoint, body)
+		return err
+	}
+	if opts.writerSink != nil {
+		s.sinkMu.Lock()
+		_, err := opts.writerSink.Write(append(body, '\n'))
+		s.sinkMu.Unlock()
+		if err != nil {
+			return s.transportFailed(ctx, opts, err, events, isError)
+		}
+		s.delivered(ctx, events)
+		return nil
+	}
+	codec, compress := negotiateCodec(opts.compress)
+	if compress != nil {
+		if body, err = compress(body); err != nil {
+			s.dropped.Add(uint64(len(events)))
+			return fmt.Errorf("lognorth: compressing batch: %w", err)
+		}
+	}
+	req, _ := http.NewRequestWithContext(ctx, "POST", endpoint+"/api/v1/events/batch", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if wire == CloudEventsBinary {
+		for name, v := range cloudEventAttrs(opts, payload[0]) {
+			req.Header.Set("ce-"+name, v.(string))
+		}
+	}
+	if compress != nil {
+		req.Header.Set("Content-Encoding", codec)
+	}
+	sign(req, opts.signingSecret, body)
+
+	release, err := s.acquire(ctx)
+	if err != nil {
+		return s.transportFailed(ctx, opts, err, events, isError)
+	}
+	defer release()
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return s.transportFailed(ctx, opts, err, events, isError)
+	}
+	defer resp.Body.Close()
+
+	// Setting Accept-Encoding ourselves disables the transport's transparent
+	// decompression, so gzip responses are unwrapped here.
+	var respBody io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if zr, err := gzip.NewReader(resp.Body); err == nil {
+			defer zr.Close()
+			respBody = zr
+		}
+	}
+	if opts.onResponse != nil {
+		b, _ := io.ReadAll(respBody)
+		opts.onResponse(resp.StatusCode, b)
+		respBody = bytes.NewReader(b)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusMultiStatus:
+		var result batchResult
+		if err := json.NewDecoder(respBody).Decode(&result); err != nil || len(result.Results) != len(events) {
+			// Without a status per event, nothing is known to be delivered.
+			err := fmt.Errorf("%w: unreadable multi-status response", ErrServer)
+			s.fail(err)
+			s.retryOrLose(events)
+			return err
+		}
+		// Per-event statuses follow the same rules as whole batches: retry
+		// within the retry limits, drop what can never succeed.
+		var accepted, retry, final []Event
+		for i, r := range result.Results {
+			switch {
+			case r.Status >= 200 && r.Status < 300:
+				accepted = append(accepted, events[i])
+			case retryableStatus(r.Status) || r.Status == http.StatusTooManyRequests:
+				retry = append(retry, events[i])
+			default:
+				final = append(final, events[i])
+			}
+		}
+		s.delivered(ctx, accepted)
+		if slices.ContainsFunc(retry, func(e Event) bool { return e.replay }) {
+			// Replay keeps its spool position and resends the batch later.
+			err := fmt.Errorf("%w: server rejected %d of %d events", ErrServer, len(retry)+len(final), len(events))
+			s.fail(err)
+			return err
+		}
+		if len(final) > 0 {
+			s.dropped.Add(uint64(len(final)))
+			s.writeFallback(final)
+		}
+		if len(retry) > 0 {
+			s.retryOrLose(retry)
+		}
+	case resp.StatusCode == http.StatusRequestEntityTooLarge && len(events) > 1 && depth < maxSplitDepth:
+		// Too large: retry each half on its own, down to single events.
+		resp.Body.Close()
+		release()
+		half := len(events) / 2
+		err := s.post(ctx, opts, endpoint, apiKey, events[:half:half], isError, depth+1)
+		if err2 := s.post(ctx, opts, endpoint, apiKey, events[half:], isError, depth+1); err == nil {
+			err = err2
+		}
+		return err
+	case resp.StatusCode == 429:
+		s.fail(errBackoff)
+		s.adjustInterval(true)
+		s.mu.Lock()
+		s.backoff = s.timeNow().Add(5 * time.Second)
+		s.mu.Unlock()
+		if isError {
+			s.lose(events)
+		} else {
+			s.requeue(events)
+		}
+		return errBackoff
+	case resp.StatusCode >= 300:
+		class := ErrServer
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			class = ErrClient
+		}
+		err := fmt.Errorf("%w: server returned %d", class, resp.StatusCode)
+		s.fail(err)
+		retry := retryableStatus(resp.StatusCode)
+		if opts.shouldRetry != nil {
+			resp.Body = io.NopCloser(respBody)
+			retry = opts.shouldRetry(resp, nil)
+		}
+		if retry {
+			s.retryOrLose(events)
+			return err
+		}
+		// A bad payload or key fails the same way every time.
+		s.dropped.Add(uint64(len(events)))
+		s.writeFallback(events)
+		return rejectedError{err}
+	default:
+		s.delivered(ctx, events)
+	}
+	return nil
+}
+
+// sign sets the SigningSecret X-Signature header of req for body, if a
+// secret is configured.
+func sign(req *http.Request, secret, body []byte) {
+	if len(secret) > 0 {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// rejectedError marks a send the server refused for good. Its events are
+// already counted as dropped, so Replay moves past them instead of resending.
+type rejectedError struct{ error }
+
+func (e rejectedError) Unwrap() error { return e.error }
+
+// Default attempts after the first for events rejected with a retryable
+// status; see ErrorRetries and BatchRetries.
+const (
+	defaultErrorRetries = 3
+	defaultBatchRetries = 1
+)
+
+// retryableStatus reports whether a failed send may succeed if repeated:
+// server errors and 408 Request Timeout. Other 4xx responses are final.
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusRequestTimeout
+}
+
+// retryOrLose requeues events that have retries left and hands the rest to
+// lose. Error events keep their larger allowance after being requeued into
+// a batch. Replayed events are never requeued; they stay in their spool file.
+func (s *Sender) retryOrLose(events []Event) {
+	opts := s.options()
+	var retry, lost []Event
+	for _, e := range events {
+		if !e.replay && e.tries < opts.retries(isErrorEvent(e)) {
+			retry = append(retry, e)
+		} else {
+			lost = append(lost, e)
+		}
+	}
+	if len(retry) > 0 {
+		s.requeue(retry)
+	}
+	if len(lost) > 0 {
+		s.lose(lost)
+	}
+}
+
+// errFlushTimeout is the cause of an auto-flush context past FlushTimeout.
+var errFlushTimeout = errors.New("lognorth: flush timeout")
+
+// transportFailed records a batch that never reached the server. After
+// FlushTimeout the events are retried within the retry limits. Otherwise
+// ShouldRetry, when set, decides between such a retry and losing them; by
+// default error events are kept and others lost.
+func (s *Sender) transportFailed(ctx context.Context, opts options, err error, events []Event, isError bool) error {
+	cause := err
+	err = fmt.Errorf("%w: %w", ErrTransport, err)
+	s.fail(err)
+	switch {
+	case context.Cause(ctx) == errFlushTimeout:
+		s.retryOrLose(events)
+	case opts.shouldRetry != nil:
+		if opts.shouldRetry(nil, cause) {
+			s.retryOrLose(events)
+		} else {
+			s.lose(events)
+		}
+	case isError:
+		s.requeue(events)
+	default:
+		s.lose(events)
+	}
+	return err
+}
+
+// lose handles events that could not be delivered: they are spooled when
+// SpoolDir is set and dropped otherwise. Events being replayed are left
+// alone, since they are still in their spool file.
+func (s *Sender) lose(events []Event) {
+	dir := s.options().spoolDir
+	if dir == "" {
+		s.dropped.Add(uint64(len(events)))
+		s.writeFallback(events)
+		return
+	}
+	events = slices.DeleteFunc(slices.Clone(events), func(e Event) bool { return e.replay })
+	if len(events) == 0 {
+		return
+	}
+	if err := s.spool(dir, events); err != nil {
+		s.dropped.Add(uint64(len(events)))
+		s.writeFallback(events)
+		return
+	}
+	s.spooled.Add(uint64(len(events)))
+}
+
+// writeFallback logs events that will never be delivered to FallbackHandler,
+// if set, as records at their original level and time.
+func (s *Sender) writeFallback(events []Event) {
+	h := s.options().fallback
+	if h == nil {
+		return
+	}
+	ctx := context.Background()
+	for _, e := range events {
+		var level slog.Level
+		if level.UnmarshalText([]byte(e.Level)) != nil {
+			level = slog.LevelInfo
+		}
+		if !h.Enabled(ctx, level) {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339, e.Timestamp)
+		r := slog.NewRecord(t, level, e.Message, 0)
+		if e.TraceID != "" {
+			r.AddAttrs(slog.String("trace_id", e.TraceID))
+		}
+		for _, k := range slices.Sorted(maps.Keys(e.Context)) {
+			r.AddAttrs(slog.Any(k, e.Context[k]))
+		}
+		h.Handle(ctx, r)
+	}
+}
+
+const (
+	spoolFile         = "spool.ndjson.gz"
+	spoolSegmentBytes = 1 << 20
+)
+
+// spoolRecord is one spooled event. It keeps the KeyResolver destination,
+// which Event does not serialize, so Replay sends the event back to its own
+// endpoint and key rather than the Sender's.
+type spoolRecord struct {
+	Event
+	DestAPIKey   string `json:"dest_api_key,omitempty"`
+	DestEndpoint string `json:"dest_endpoint,omitempty"`
+}
+
+// spool appends events to the active spool file in dir as one gzip member of
+// JSON lines, rotating the file into a segment once it is large enough and
+// enforcing SpoolMaxBytes.
+func (s *Sender) spool(dir string, events []Event) error {
+	var buf bytes.Buffer
+	opts := s.options()
+	gz := gzip.NewWriter(&buf)
+	hasErrors := false
+	for _, e := range events {
+		b, err := opts.marshal(spoolRecord{Event: e, DestAPIKey: e.dest.apiKey, DestEndpoint: e.dest.endpoint})
+		if err != nil {
+			return err
+		}
+		gz.Write(b)
+		gz.Write([]byte{'\n'})
+		hasErrors = hasErrors || isErrorEvent(e)
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	s.spoolMu.Lock()
+	defer s.spoolMu.Unlock()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, spoolFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	info, err := f.Stat()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	s.spoolErrors = s.spoolErrors || hasErrors
+
+	segment := int64(spoolSegmentBytes)
+	if opts.spoolMax > 0 {
+		segment = min(segment, max(opts.spoolMax/4, 1))
+	}
+	if info.Size() >= segment {
+		if err := s.rotateSpool(dir); err != nil {
+			return err
+		}
+	}
+	if opts.spoolMax > 0 {
+		s.trimSpool(dir, opts.spoolMax)
+	}
+	return nil
+}
+
+// rotateSpool renames the active spool file to a new segment for Replay,
+// marking segments that hold error events. Callers hold s.spoolMu.
+func (s *Sender) rotateSpool(dir string) error {
+	suffix := ".replay"
+	if s.spoolErrors {
+		suffix = ".errors.replay"
+	}
+	n := s.timeNow().UnixNano()
+	for segmentExists(dir, n) {
+		n++
+	}
+	err := os.Rename(filepath.Join(dir, spoolFile), filepath.Join(dir, fmt.Sprintf("spool-%020d%s", n, suffix)))
+	if err == nil {
+		s.spoolErrors = false
+	}
+	return err
+}
+
+func segmentExists(dir string, n int64) bool {
+	for _, suffix := range []string{".replay", ".errors.replay"} {
+		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("spool-%020d%s", n, suffix))); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// trimSpool deletes the oldest segments until the spool fits in limit,
+// preferring segments without error events. Callers hold s.spoolMu.
+func (s *Sender) trimSpool(dir string, limit int64) {
+	segments, _ := filepath.Glob(filepath.Join(dir, "spool-*.replay"))
+	slices.Sort(segments)
+	var total int64
+	sizes := make(map[string]int64, len(segments))
+	for _, file := range append([]string{filepath.Join(dir, spoolFile)}, segments...) {
+		if info, err := os.Stat(file); err == nil {
+			sizes[file] = info.Size()
+			total += info.Size()
+		}
+	}
+	for total > limit && len(segments) > 0 {
+		i := slices.IndexFunc(segments, func(f string) bool { return !strings.HasSuffix(f, ".errors.replay") })
+		if i < 0 {
+			i = 0
+		}
+		file := segments[i]
+		segments = slices.Delete(segments, i, i+1)
+		if events, pos, err := readSpool(file); err == nil {
+			s.dropped.Add(uint64(max(len(events)-pos, 0)))
+		}
+		os.Remove(file)
+		os.Remove(file + ".pos")
+		total -= sizes[file]
+	}
+}
+
+// readSpool returns the events in a spool segment, gzip-compressed or plain,
+// and the saved replay position. A truncated final gzip member, left by a
+// crash mid-write, yields the events before it.
+func readSpool(file string) ([]Event, int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, err
+		}
+		data, _ = io.ReadAll(gz)
+	}
+	var events []Event
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var rec spoolRecord
+		if json.Unmarshal(line, &rec) == nil {
+			e := rec.Event
+			e.dest = destination{apiKey: rec.DestAPIKey, endpoint: rec.DestEndpoint}
+			e.replay = true
+			events = append(events, e)
+		}
+	}
+	pos := 0
+	if b, err := os.ReadFile(file + ".pos"); err == nil {
+		pos, _ = strconv.Atoi(string(bytes.TrimSpace(b)))
+	}
+	return events, pos, nil
+}
+
+// Replay re-sends events spooled by the default Sender at up to rate events
+// per second.
+func Replay(ctx context.Context, rate int) error {
+	return std.Replay(ctx, rate)
 }
 
-type ctxKey int
+// Replay re-sends the events in SpoolDir at up to rate events per second
+// (unlimited when rate <= 0), oldest first. Progress is saved after every
+// batch, so a Replay stopped by ctx or a failed send resumes where it left
+// off on the next call. Events spooled while it runs wait for the next call.
+func (s *Sender) Replay(ctx context.Context, rate int) error {
+	dir := s.options().spoolDir
+	if dir == "" {
+		return errors.New("lognorth: no SpoolDir configured")
+	}
+	s.spoolMu.Lock()
+	_, err := os.Stat(filepath.Join(dir, spoolFile))
+	if err == nil {
+		err = s.rotateSpool(dir)
+	}
+	s.spoolMu.Unlock()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "spool-*.replay"))
+	if err != nil {
+		return err
+	}
+	slices.Sort(files)
+	for _, file := range files {
+		// A segment deleted by SpoolMaxBytes meanwhile is skipped.
+		if err := s.replayFile(ctx, file, rate); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
 
-const traceIDKey ctxKey = 0
+// replayFile sends the events of one spool file from its saved position,
+// then removes it.
+func (s *Sender) replayFile(ctx context.Context, file string, rate int) error {
+	events, pos, err := readSpool(file)
+	if err != nil {
+		return err
+	}
 
-func withTraceID(ctx context.Context, traceID string) context.Context {
-	return context.WithValue(ctx, traceIDKey, traceID)
+	s.mu.Lock()
+	size := s.batchSize()
+	s.mu.Unlock()
+	if rate > 0 {
+		size = min(size, rate)
+	}
+	start, sent := time.Now(), 0
+	for pos < len(events) {
+		if rate > 0 {
+			wait := time.NewTimer(time.Until(start.Add(time.Duration(sent) * time.Second / time.Duration(rate))))
+			select {
+			case <-ctx.Done():
+				wait.Stop()
+				return ctx.Err()
+			case <-wait.C:
+			}
+		}
+		batch := events[pos:min(pos+size, len(events))]
+		// A batch rejected for good is dropped, not retried on every call.
+		var rejected rejectedError
+		if err := s.send(ctx, batch, false); err != nil && !errors.As(err, &rejected) {
+			return err
+		}
+		pos += len(batch)
+		sent += len(batch)
+		if err := os.WriteFile(file+".pos", []byte(strconv.Itoa(pos)), 0o644); err != nil {
+			return err
+		}
+	}
+	os.Remove(file + ".pos")
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
 }
 
-func traceIDFromContext(ctx context.Context) string {
-	if v, ok := ctx.Value(traceIDKey).(string); ok {
-		return v
+// flushInterval returns the current adaptive flush interval. Callers hold s.mu.
+func (s *Sender) flushInterval() time.Duration {
+	if s.interval == 0 {
+		return defaultFlushInterval
 	}
-	return ""
+	return s.interval
 }
 
-func generateTraceID() string {
-	b := make([]byte, 8)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+// adjustInterval stretches the flush interval when the server throttles us and
+// eases it back toward the base interval as sends succeed.
+func (s *Sender) adjustInterval(throttled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	multiplier, recovery, ceiling := s.opts.backoffMultiplier, s.opts.recoveryFactor, s.opts.maxFlushInterval
+	if multiplier <= 0 {
+		multiplier = defaultBackoffMultiplier
+	}
+	if recovery <= 0 {
+		recovery = defaultRecoveryFactor
+	}
+	if ceiling <= 0 {
+		ceiling = defaultMaxFlushInterval
+	}
+
+	interval := s.flushInterval()
+	if throttled {
+		interval = min(time.Duration(float64(interval)*multiplier), ceiling)
+	} else {
+		interval = max(time.Duration(float64(interval)*recovery), defaultFlushInterval)
+	}
+	s.interval = interval
 }
 
-var (
-	mu       sync.Mutex
-	apiKey   string
-	endpoint string
-	buffer   []event
-	timer    *time.Timer
-	backoff  time.Time
-)
+// fail records a failed request under its class and reports it to OnError.
+// The next successful send drains whatever piled up in the buffer meanwhile.
+func (s *Sender) fail(err error) {
+	s.failed.Add(1)
+	var class FailureClass
+	if errors.As(err, &class) {
+		switch class {
+		case ErrTransport:
+			s.transportErrors.Add(1)
+		case ErrClient:
+			s.clientErrors.Add(1)
+		case ErrServer:
+			s.serverErrors.Add(1)
+		case ErrRateLimited:
+			s.rateLimited.Add(1)
+		}
+	}
+	s.mu.Lock()
+	s.degraded = true
+	fn := s.opts.onError
+	s.mu.Unlock()
+	if fn != nil {
+		fn(err)
+	}
+}
 
-func init() {
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		<-c
-		Flush()
-		os.Exit(0)
-	}()
+// delivered records accepted events and reports their IDs to OnDelivered. If
+// this is the first success after a failure, it immediately flushes the
+// backlog instead of waiting for the timer.
+func (s *Sender) delivered(ctx context.Context, events []Event) {
+	s.sent.Add(uint64(len(events)))
+	if n, ok := ctx.Value(deliveredKey).(*atomic.Int64); ok {
+		n.Add(int64(len(events)))
+	}
+	s.adjustInterval(false)
+	if fn := s.options().onDelivered; fn != nil && len(events) > 0 {
+		ids := make([]string, len(events))
+		for i, e := range events {
+			ids[i] = e.ID
+		}
+		fn(ids)
+	}
+	s.mu.Lock()
+	drain := s.degraded && len(s.buffer) > 0
+	s.degraded = false
+	s.mu.Unlock()
+	if drain {
+		s.inflight.Go(s.Flush)
+	}
 }
 
-// ErrorFields are the structured error fields added to context for error events.
-// SDKs populate these automatically; the server uses them for three-tier issue grouping.
-type ErrorFields struct {
-	Error      string `json:"error"`
-	ErrorClass string `json:"error_class"`
-	ErrorFile  string `json:"error_file"`
-	ErrorLine  int    `json:"error_line"`
-	ErrorCaller string `json:"error_caller"`
-	StackTrace string `json:"stack_trace"`
+// batchResult is the body of a 207 partial-success response: one status per
+// event, in the order the events were sent.
+type batchResult struct {
+	Results []struct {
+		Status int `json:"status"`
+	} `json:"results"`
 }
 
-// Config sets the endpoint and API key. Call once at startup.
-func Config(url, key string) {
-	mu.Lock()
-	defer mu.Unlock()
-	endpoint = url
-	apiKey = key
+// Stats is a point-in-time view of a Sender's delivery counters.
+type Stats struct {
+	Sent       uint64 // events accepted by the server
+	Dropped    uint64 // events discarded without delivery
+	Expired    uint64 // events discarded for exceeding MaxEventAge
+	Failed     uint64 // requests that errored or got a non-2xx response
+	Buffered   int    // events waiting for the next flush
+	BackingOff bool   // true while sends are paused after a 429
+
+	// Failed broken down by FailureClass.
+	TransportErrors uint64
+	ClientErrors    uint64
+	ServerErrors    uint64
+	RateLimited     uint64
+
+	Spooled uint64 // events written to SpoolDir instead of being dropped
+
+	FlushInterval time.Duration // current adaptive flush interval
 }
 
-// Log sends a regular log message. Batched automatically.
-func Log(message string, ctx map[string]any) {
-	logEvent(message, ctx, "")
+// Stats returns the current delivery counters for s.
+func (s *Sender) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Sent:       s.sent.Load(),
+		Dropped:    s.dropped.Load(),
+		Expired:    s.expired.Load(),
+		Failed:     s.failed.Load(),
+		Buffered:   len(s.buffer),
+		BackingOff: s.timeNow().Before(s.backoff),
+
+		TransportErrors: s.transportErrors.Load(),
+		ClientErrors:    s.clientErrors.Load(),
+		ServerErrors:    s.serverErrors.Load(),
+		RateLimited:     s.rateLimited.Load(),
+
+		Spooled: s.spooled.Load(),
+
+		FlushInterval: s.flushInterval(),
+	}
 }
 
-func logEvent(message string, ctx map[string]any, traceID string, durationMS ...int) {
-	e := event{
-		Message:   message,
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		TraceID:   traceID,
-		Context:   ctx,
+// ErrUnauthorized is returned by Ping when the server rejects the API key.
+var ErrUnauthorized = errors.New("lognorth: API key rejected")
+
+// Ping sends an empty batch to check that the endpoint is reachable and the
+// API key is accepted, e.g. at startup. It does not touch the buffer or the
+// delivery counters.
+func (s *Sender) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	endpoint, apiKey, keyFunc, secret := s.endpoint, s.apiKey, s.opts.apiKeyFunc, s.opts.signingSecret
+	s.mu.Unlock()
+	if endpoint == "" {
+		return errors.New("lognorth: no endpoint configured")
 	}
-	if len(durationMS) > 0 {
-		e.DurationMS = durationMS[0]
+	if keyFunc != nil {
+		key, err := keyFunc()
+		if err != nil {
+			return fmt.Errorf("lognorth: fetching API key: %w", err)
+		}
+		apiKey = key
 	}
-	mu.Lock()
-	buffer = append(buffer, e)
-	n := len(buffer)
-	if timer == nil {
-		timer = time.AfterFunc(5*time.Second, Flush)
+	body := []byte(`{"events":[]}`)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint+"/api/v1/events/batch", bytes.NewReader(body))
+	if err != nil {
+		return err
 	}
-	mu.Unlock()
-
-	if n >= 10 {
-		go Flush()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	sign(req, secret, body)
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTransport, err)
 	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: server returned %d", ErrUnauthorized, resp.StatusCode)
+	case resp.StatusCode == 429:
+		return fmt.Errorf("%w: server returned %d", ErrRateLimited, resp.StatusCode)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return fmt.Errorf("%w: server returned %d", ErrClient, resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("%w: server returned %d", ErrServer, resp.StatusCode)
+	}
+	return nil
 }
 
-// Error sends an error log immediately.
-func Error(message string, err error, ctx map[string]any) {
-	errorEvent(message, err, ctx, "", 2)
+// SetAPIKey replaces the API key of the default Sender.
+func SetAPIKey(key string) {
+	std.SetAPIKey(key)
 }
 
-func errorEvent(message string, err error, ctx map[string]any, traceID string, callerSkip int) {
-	if ctx == nil {
-		ctx = make(map[string]any)
-	}
-	ctx["error"] = err.Error()
+// SetAPIKey replaces the API key of s for every request from now on,
+// including retries of events buffered before the change.
+func (s *Sender) SetAPIKey(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKey = key
+}
 
-	errorClass := "error"
-	if err != nil {
-		t := reflect.TypeOf(err)
-		if t != nil {
-			errorClass = strings.TrimPrefix(t.String(), "*")
-		}
-	}
-	ctx["error_class"] = errorClass
+// Settings is the effective configuration of a Sender, with defaults filled
+// in. APIKey is masked to its last four characters, so a Settings is safe to
+// print or log.
+type Settings struct {
+	Endpoint      string
+	ErrorEndpoint string
+	APIKey        string
 
-	if pc, file, line, ok := runtime.Caller(callerSkip); ok {
-		ctx["error_file"] = filepath.Base(file)
-		ctx["error_line"] = line
-		if fn := runtime.FuncForPC(pc); fn != nil {
-			parts := strings.Split(fn.Name(), ".")
-			ctx["error_caller"] = parts[len(parts)-1]
-		}
-	}
+	BatchSize      int
+	MinBatchSize   int
+	MaxBatchBytes  int
+	MaxBufferSize  int
+	SoftBufferSize int
+	BufferErrors   bool
+	SampleRate     float64
+	MaxEventAge    time.Duration
 
-	buf := make([]byte, 4096)
-	n := runtime.Stack(buf, false)
-	ctx["stack_trace"] = string(buf[:n])
+	FlushInterval     time.Duration
+	MaxFlushInterval  time.Duration
+	BackoffMultiplier float64
+	RecoveryFactor    float64
+	ShutdownGrace     time.Duration
+	ErrorSendTimeout  time.Duration
+	ErrorRetries      int
+	BatchRetries      int
+	TraceHeader       string
+}
 
-	go send([]event{{
-		Message:   message,
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		TraceID:   traceID,
-		Context:   ctx,
-	}}, true)
+// maskKey hides all but the last four characters of key.
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return strings.Repeat("*", len(key))
+	}
+	return strings.Repeat("*", len(key)-4) + key[len(key)-4:]
 }
 
-// Flush sends all buffered events.
-func Flush() {
-	mu.Lock()
-	if timer != nil {
-		timer.Stop()
-		timer = nil
+// Config returns the effective configuration of s.
+func (s *Sender) Config() Settings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.opts
+	c := Settings{
+		Endpoint:      s.endpoint,
+		ErrorEndpoint: o.errorEndpoint,
+		APIKey:        maskKey(s.apiKey),
+
+		BatchSize:      s.batchSize(),
+		MinBatchSize:   o.minBatchSize,
+		MaxBatchBytes:  o.maxBatchBytes,
+		MaxBufferSize:  o.maxBufferSize,
+		SoftBufferSize: o.softBufferSize,
+		BufferErrors:   o.bufferErrors,
+		SampleRate:     1,
+		MaxEventAge:    o.maxEventAge,
+
+		FlushInterval:     defaultFlushInterval,
+		MaxFlushInterval:  cmp.Or(o.maxFlushInterval, defaultMaxFlushInterval),
+		BackoffMultiplier: cmp.Or(o.backoffMultiplier, defaultBackoffMultiplier),
+		RecoveryFactor:    cmp.Or(o.recoveryFactor, defaultRecoveryFactor),
+		ShutdownGrace:     cmp.Or(o.shutdownGrace, defaultShutdownGrace),
+		ErrorSendTimeout:  cmp.Or(o.errorTimeout, defaultErrorSendTimeout),
+		ErrorRetries:      o.retries(true),
+		BatchRetries:      o.retries(false),
+		TraceHeader:       cmp.Or(o.traceHeader, defaultTraceHeader),
 	}
-	if len(buffer) == 0 {
-		mu.Unlock()
-		return
+	if o.sampled {
+		c.SampleRate = o.sampleRate
 	}
-	events := buffer
-	buffer = nil
-	mu.Unlock()
+	return c
+}
 
-	send(events, false)
+// SetSampleRate changes the sample rate of s at runtime, e.g. to 1 to keep
+// everything during an incident. It is safe to call concurrently with logging.
+func (s *Sender) SetSampleRate(r float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts.sampled, s.opts.sampleRate = true, r
 }
 
-func send(events []event, isError bool) {
-	if len(events) == 0 || endpoint == "" {
-		return
+// keep reports whether r survives sampling under o.
+func (s *Sender) keep(o options, r slog.Record) bool {
+	if !o.sampled || r.Level >= slog.LevelError || o.sampleRate >= 1 {
+		return true
 	}
-
-	mu.Lock()
-	if time.Now().Before(backoff) {
-		mu.Unlock()
-		return
+	if o.sampleMode == KeepFirst && s.seen.firstSeen(r.Message) {
+		return true
 	}
-	mu.Unlock()
+	return s.sampleDraw(o) < o.sampleRate
+}
 
-	body, _ := json.Marshal(map[string]any{"events": events})
-	req, _ := http.NewRequest("POST", endpoint+"/api/v1/events/batch", bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+// sampleDraw returns a number in [0, 1) from the SampleSeed generator, or
+// from the shared randomly seeded one.
+func (s *Sender) sampleDraw(o options) float64 {
+	if !o.sampleSeeded {
+		return mathrand.Float64()
+	}
+	s.rngMu.Lock()
+	defer s.rngMu.Unlock()
+	if s.rng == nil {
+		s.rng = mathrand.New(mathrand.NewPCG(uint64(o.sampleSeed), 0))
+	}
+	return s.rng.Float64()
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		if isError {
-			mu.Lock()
-			buffer = append(events, buffer...)
-			mu.Unlock()
-		}
-		return
+// Snapshot returns a deep copy of the events waiting in s's buffer without
+// sending or draining them.
+func (s *Sender) Snapshot() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]Event, len(s.buffer))
+	for i, e := range s.buffer {
+		e.Context = cloneContext(e.Context)
+		events[i] = e
 	}
-	resp.Body.Close()
+	return events
+}
 
-	if resp.StatusCode == 429 {
-		mu.Lock()
-		backoff = time.Now().Add(5 * time.Second)
-		if !isError {
-			buffer = append(events, buffer...)
+func cloneContext(ctx map[string]any) map[string]any {
+	if ctx == nil {
+		return nil
+	}
+	out := make(map[string]any, len(ctx))
+	for k, v := range ctx {
+		if m, ok := v.(map[string]any); ok {
+			v = cloneContext(m)
 		}
-		mu.Unlock()
+		out[k] = v
 	}
+	return out
 }
 
 // Handler implements slog.Handler for integration with log/slog.
 type Handler struct {
-	attrs []slog.Attr
+	sender *Sender
+	attrs  []slog.Attr // already nested under the groups open when added
+	groups []string    // groups opened by WithGroup, outermost first
 }
 
 // NewHandler creates a new LogNorth slog handler.
 func NewHandler() *Handler {
-	return &Handler{}
+	return std.NewHandler()
+}
+
+// NewHandler creates a slog handler that sends through s. Handlers from the
+// same Sender share its buffer and batches.
+func (s *Sender) NewHandler() *Handler {
+	return &Handler{sender: s}
+}
+
+// Ping checks the endpoint and API key of the handler's Sender.
+func (h *Handler) Ping(ctx context.Context) error {
+	return h.sender.Ping(ctx)
+}
+
+// SetAPIKey replaces the API key of the handler's Sender at runtime.
+func (h *Handler) SetAPIKey(key string) {
+	h.sender.SetAPIKey(key)
+}
+
+// Config returns the effective configuration of the handler's Sender.
+func (h *Handler) Config() Settings {
+	return h.sender.Config()
+}
+
+// Stats returns the delivery counters of the handler's Sender.
+func (h *Handler) Stats() Stats {
+	return h.sender.Stats()
+}
+
+// Snapshot returns a copy of the events pending in the handler's Sender.
+func (h *Handler) Snapshot() []Event {
+	return h.sender.Snapshot()
+}
+
+// FlushErrors sends only the error events pending in the handler's Sender.
+func (h *Handler) FlushErrors() {
+	h.sender.FlushErrors()
+}
+
+// FlushN flushes the handler's Sender and returns how many events it
+// delivered.
+func (h *Handler) FlushN() (int, error) {
+	return h.sender.FlushN()
+}
+
+// Wait blocks until the background sends of the handler's Sender finish.
+func (h *Handler) Wait() {
+	h.sender.Wait()
+}
+
+// Close closes the handler's Sender.
+func (h *Handler) Close() error {
+	return h.sender.Close()
+}
+
+// SetSampleRate changes the sample rate of the handler's Sender at runtime.
+func (h *Handler) SetSampleRate(r float64) {
+	h.sender.SetSampleRate(r)
 }
 
 func (h *Handler) Enabled(_ context.Context, _ slog.Level) bool { return true }
 
 func (h *Handler) Handle(c context.Context, r slog.Record) error {
-	ctx := make(map[string]any)
-	traceID := traceIDFromContext(c)
-
-	for _, a := range h.attrs {
-		ctx[a.Key] = a.Value.Any()
+	opts := h.sender.options()
+	if opts.sendMinSet && r.Level < opts.sendMinLevel {
+		return nil
 	}
-	r.Attrs(func(a slog.Attr) bool {
-		if a.Key == "error" {
-			if err, ok := a.Value.Any().(error); ok {
-				ctx["error"] = err.Error()
-			} else {
-				ctx["error"] = a.Value.Any()
+	if !h.sender.keep(opts, r) {
+		return nil
+	}
+	attrs := h.attrs
+	if registered := registeredAttrs(c); len(registered) > 0 {
+		attrs = append(attrs[:len(attrs):len(attrs)], registered...)
+	}
+	if len(opts.levelFields) > 0 {
+		for _, threshold := range slices.Sorted(maps.Keys(opts.levelFields)) {
+			if r.Level >= threshold {
+				attrs = append(attrs[:len(attrs):len(attrs)], opts.levelFields[threshold]...)
+			}
+		}
+	}
+	for _, extract := range opts.contextExtractors {
+		attrs = append(attrs[:len(attrs):len(attrs)], extract(c)...)
+	}
+	truncated := false
+	if limit := opts.maxAttrs; limit > 0 && len(attrs)+r.NumAttrs() > limit {
+		attrs, r = truncateAttrs(attrs, r, limit)
+		truncated = true
+	}
+	ctx := recordContext(attrs, h.groups, r, opts.maxStringLen)
+	if truncated {
+		ctx["attrs_truncated"] = true
+	}
+	var template string
+	if key := opts.templateKey; key != "" {
+		if t, ok := ctx[key].(string); ok {
+			template = t
+			delete(ctx, key)
+			if len(ctx) == 0 {
+				ctx = nil
 			}
+		}
+	}
+	var correlationID string
+	if key := cmp.Or(opts.correlationKey, defaultCorrelationKey); ctx[key] != nil {
+		if id, ok := ctx[key].(string); ok {
+			correlationID = id
 		} else {
-			ctx[a.Key] = a.Value.Any()
+			correlationID = fmt.Sprint(ctx[key])
 		}
-		return true
-	})
+		delete(ctx, key)
+		if len(ctx) == 0 {
+			ctx = nil
+		}
+	}
+	e := Event{
+		Level:         opts.levelName(r.Level),
+		Message:       truncateString(r.Message, opts.maxStringLen),
+		TraceID:       traceIDFromContext(c),
+		Template:      template,
+		CorrelationID: correlationID,
+		Context:       ctx,
+	}
+	if !r.Time.IsZero() || opts.keepZeroTime {
+		e.Timestamp = r.Time.UTC().Format(time.RFC3339)
+	}
+	if resolve := opts.keyResolver; resolve != nil {
+		e.dest.apiKey, e.dest.endpoint = resolve(c)
+	}
+	if extract := opts.traceExtractor; extract != nil {
+		if traceID, spanID := extract(c); traceID != "" {
+			e.TraceID, e.SpanID = traceID, spanID
+		}
+	}
 
 	if r.Level >= slog.LevelError {
-		errVal := ctx["error"]
-		if errVal == nil {
-			errVal = r.Message
+		var err error
+		r.Attrs(func(a slog.Attr) bool {
+			if e, ok := a.Value.Any().(error); ok && a.Key == "error" {
+				err = e
+			}
+			return true
+		})
+		if err == nil {
+			errVal := ctx["error"]
+			if errVal == nil {
+				errVal = r.Message
+			}
+			err = fmt.Errorf("%v", errVal)
 		}
-		errorEvent(r.Message, fmt.Errorf("%v", errVal), ctx, traceID, 4)
+		h.sender.errorEvent(e, err, 4)
 	} else {
-		logEvent(r.Message, ctx, traceID)
+		h.sender.logEvent(e)
 	}
 	return nil
 }
 
+// recordContext merges handler attrs and record attrs into an event context,
+// nesting the record attrs under groups and truncating strings longer than
+// maxLen (when positive). It returns nil when there are none,
+// so attr-free logs skip the map allocation and the event omits its context
+// field.
+func recordContext(attrs []slog.Attr, groups []string, r slog.Record, maxLen int) map[string]any {
+	if len(attrs) == 0 && r.NumAttrs() == 0 {
+		return nil
+	}
+	ctx := make(map[string]any, len(attrs)+r.NumAttrs())
+	for _, a := range attrs {
+		addAttr(ctx, a, maxLen)
+	}
+	if len(groups) == 0 {
+		r.Attrs(func(a slog.Attr) bool {
+			addAttr(ctx, a, maxLen)
+			return true
+		})
+		return ctx
+	}
+	recAttrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		recAttrs = append(recAttrs, a)
+		return true
+	})
+	if len(recAttrs) > 0 {
+		addAttr(ctx, nest(groups, recAttrs), maxLen)
+	}
+	return ctx
+}
+
+// truncateAttrs keeps the first limit of attrs followed by r's attrs.
+func truncateAttrs(attrs []slog.Attr, r slog.Record, limit int) ([]slog.Attr, slog.Record) {
+	if len(attrs) >= limit {
+		attrs = attrs[:limit:limit]
+	}
+	kept := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	room := limit - len(attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		if room == 0 {
+			return false
+		}
+		kept.AddAttrs(a)
+		room--
+		return true
+	})
+	return attrs, kept
+}
+
+// nest wraps attrs in one group attr per name, outermost first.
+func nest(groups []string, attrs []slog.Attr) slog.Attr {
+	a := slog.Attr{Value: slog.GroupValue(attrs...)}
+	for i := len(groups) - 1; i >= 0; i-- {
+		a = slog.Attr{Key: groups[i], Value: slog.GroupValue(a)}
+	}
+	return a
+}
+
+// addAttr stores a in ctx. Groups become nested objects (inlined when their
+// key is empty, merged when the key repeats, skipped when empty) and error
+// values anywhere become their Error() string, since most errors marshal to {}.
+func addAttr(ctx map[string]any, a slog.Attr, maxLen int) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if len(v.Group()) == 0 {
+			return
+		}
+		group := ctx
+		if a.Key != "" {
+			var ok bool
+			if group, ok = ctx[a.Key].(map[string]any); !ok {
+				group = make(map[string]any, len(v.Group()))
+				ctx[a.Key] = group
+			}
+		}
+		for _, ga := range v.Group() {
+			addAttr(group, ga, maxLen)
+		}
+		return
+	}
+	if err, ok := v.Any().(error); ok {
+		ctx[a.Key] = truncateString(err.Error(), maxLen)
+		return
+	}
+	if v.Kind() == slog.KindString {
+		ctx[a.Key] = truncateString(v.String(), maxLen)
+		return
+	}
+	ctx[a.Key] = v.Any()
+}
+
+// truncateString cuts s to at most maxLen bytes, on a rune boundary, and notes
+// how much was cut. A maxLen of zero or less leaves s alone.
+func truncateString(s string, maxLen int) string {
+	if maxLen <= 0 || len(s) <= maxLen {
+		return s
+	}
+	cut := maxLen
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s…[truncated %d bytes]", s[:cut], len(s)-cut)
+}
+
 func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return &Handler{attrs: append(h.attrs, attrs...)}
+	if len(attrs) == 0 {
+		return h
+	}
+	if len(h.groups) > 0 {
+		attrs = []slog.Attr{nest(h.groups, attrs)}
+	}
+	return &Handler{sender: h.sender, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...), groups: h.groups}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &Handler{sender: h.sender, attrs: h.attrs, groups: append(h.groups[:len(h.groups):len(h.groups)], name)}
+}
+
+// Recorder captures the events of a handler from NewTestHandler in memory.
+// It is safe for concurrent use.
+type Recorder struct {
+	sender *Sender
+	mu     sync.Mutex
+	events []Event
+}
+
+// NewTestHandler returns a handler that delivers to the returned Recorder
+// instead of a server, for asserting on what an application logs. opts apply
+// as with NewSender; errors are buffered so events are recorded in log order.
+func NewTestHandler(opts ...Option) (*Handler, *Recorder) {
+	rec := &Recorder{}
+	opts = append([]Option{BufferErrors(true)}, opts...)
+	s := NewSender("", "", append(opts, WithTransport(rec))...)
+	rec.sender = s
+	return s.NewHandler(), rec
+}
+
+// Events flushes the handler's buffer, waits for background sends, and
+// returns a copy of every event delivered so far, oldest first.
+func (r *Recorder) Events() []Event {
+	r.sender.Flush()
+	r.sender.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]Event, len(r.events))
+	for i, e := range r.events {
+		e.Context = cloneContext(e.Context)
+		events[i] = e
+	}
+	return events
+}
+
+// Reset discards the recorded events and anything still buffered.
+func (r *Recorder) Reset() {
+	r.sender.Wait()
+	r.sender.mu.Lock()
+	r.sender.buffer, r.sender.bytes = nil, 0
+	r.sender.signalSpace()
+	r.sender.mu.Unlock()
+	r.mu.Lock()
+	r.events = nil
+	r.mu.Unlock()
 }
 
-func (h *Handler) WithGroup(string) slog.Handler { return h }
+// Send records events; it makes Recorder a Transport.
+func (r *Recorder) Send(_ context.Context, events []Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, events...)
+	return nil
+}
 
 // Middleware logs HTTP requests with trace_id propagation.
 func Middleware(next http.Handler) http.Handler {
+	return std.Middleware(next)
+}
+
+// Middleware logs HTTP requests through s with trace_id propagation. The
+// route field and the message use the pattern matched by an http.ServeMux
+// inside the middleware, e.g. "/users/{id}", falling back to the
+// PathNormalizer result or the raw path.
+//
+// Logging never waits on the ingest endpoint: the request event is buffered,
+// and the error event of a panic is handed to the background error worker,
+// which sends it under its own ErrorSendTimeout context rather than the
+// request's. A slow or unreachable endpoint therefore adds no latency to the
+// response, and request teardown does not cancel the send. Only BlockOnFull
+// can make a request wait, and only for its configured bound.
+func (s *Sender) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opts := s.options()
 		start := time.Now()
 		rw := &responseWriter{ResponseWriter: w, status: 200}
 
-		traceID := r.Header.Get("X-Trace-ID")
+		header := opts.traceHeader
+		if header == "" {
+			header = defaultTraceHeader
+		}
+		traceID := r.Header.Get(header)
+		if traceID == "" && opts.requestID != nil {
+			traceID = opts.requestID(r.Context())
+		}
 		if traceID == "" {
-			traceID = generateTraceID()
+			if opts.traceIDGen != nil {
+				traceID = opts.traceIDGen()
+			} else {
+				traceID = generateTraceID()
+			}
 		}
-		w.Header().Set("X-Trace-ID", traceID)
-		ctx := withTraceID(r.Context(), traceID)
+		w.Header().Set(header, traceID)
+		ra := &requestAttrs{}
+		ctx := context.WithValue(ContextWithTraceID(r.Context(), traceID), requestAttrsKey, ra)
 		r = r.WithContext(ctx)
 
-		next.ServeHTTP(rw, r)
+		path := r.URL.Path
+		if opts.pathNormalizer != nil {
+			path = opts.pathNormalizer(r)
+		}
+		skip, _ := r.Context().Value(noLogKey).(bool)
+		skip = skip || slices.Contains(opts.skipPaths, r.URL.Path)
+		if opts.logStart && !skip {
+			s.logEvent(Event{
+				Level:   opts.levelName(slog.LevelInfo),
+				Message: fmt.Sprintf("%s %s started", r.Method, path),
+				TraceID: traceID,
+				Context: map[string]any{"method": r.Method, "path": path, "phase": "started", "client_ip": clientIP(r, opts.trustProxyHeaders)},
+			})
+		}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			if !rw.wroteHeader {
+				rw.WriteHeader(http.StatusInternalServerError)
+			}
+			err, ok := v.(error)
+			if !ok {
+				err = fmt.Errorf("%v", v)
+			}
+			s.errorEvent(Event{
+				Message: fmt.Sprintf("panic: %v", v),
+				TraceID: traceID,
+				Context: map[string]any{"method": r.Method, "path": path, "status": rw.status},
+			}, err, 3)
+			if !opts.recoverPanics {
+				panic(v)
+			}
+		}()
 
-		logEvent(
-			fmt.Sprintf("%s %s → %d", r.Method, r.URL.Path, rw.status),
-			map[string]any{"method": r.Method, "path": r.URL.Path, "status": rw.status},
-			traceID,
-			int(time.Since(start).Milliseconds()),
-		)
+		next.ServeHTTP(rw, r)
+		if skip {
+			return
+		}
+		duration := time.Since(start)
+		level := slog.LevelInfo
+		route := routePattern(r.Pattern)
+		if route == "" {
+			route = path
+		}
+		fields := map[string]any{"method": r.Method, "path": path, "route": route, "status": rw.status, "client_ip": clientIP(r, opts.trustProxyHeaders)}
+		if len(opts.captureHeaders) > 0 {
+			headers := make(map[string]any)
+			for _, name := range opts.captureHeaders {
+				if v := r.Header.Values(name); len(v) > 0 {
+					headers[http.CanonicalHeaderKey(name)] = strings.Join(v, ", ")
+				}
+			}
+			if len(headers) > 0 {
+				fields["headers"] = headers
+			}
+		}
+		if len(opts.captureQueryParams) > 0 {
+			values := r.URL.Query()
+			query := make(map[string]any)
+			for _, name := range opts.captureQueryParams {
+				if v, ok := values[name]; ok {
+					query[name] = strings.Join(v, ", ")
+				}
+			}
+			if len(query) > 0 {
+				fields["query"] = query
+			}
+		}
+		if opts.slowRequestThreshold > 0 && duration > opts.slowRequestThreshold {
+			level = slog.LevelWarn
+			fields["slow"] = true
+		}
+		if len(opts.latencyBuckets) > 0 {
+			fields["latency_bucket"] = latencyBucket(opts.latencyBuckets, duration)
+		}
+		ra.mu.Lock()
+		for _, a := range ra.attrs {
+			if _, ok := fields[a.Key]; !ok {
+				addAttr(fields, a, opts.maxStringLen)
+			}
+		}
+		ra.mu.Unlock()
+		s.logEvent(Event{
+			Level:      opts.levelName(level),
+			Message:    fmt.Sprintf("%s %s → %d", r.Method, route, rw.status),
+			DurationMS: int(duration.Milliseconds()),
+			TraceID:    traceID,
+			Context:    fields,
+		})
 	})
 }
 
 type responseWriter struct {
 	http.ResponseWriter
-	status int
+	status      int
+	wroteHeader bool
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
 	rw.status = code
+	rw.wroteHeader = true
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush passes through to the wrapped writer so streaming responses such as
+// SSE work behind Middleware.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		rw.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.NewResponseController reach the wrapped writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -1,14 +1,35 @@
 package lognorth
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"weak"
 )
 
 func TestLog(t *testing.T) {
@@ -31,7 +52,7 @@ func TestLog(t *testing.T) {
 	Log("User signed up", map[string]any{"user_id": 123})
 	Flush()
 
-	time.Sleep(50 * time.Millisecond)
+	Wait()
 
 	mu.Lock()
 	defer mu.Unlock()
@@ -71,7 +92,7 @@ func TestError(t *testing.T) {
 
 	Error("Checkout failed", fmt.Errorf("connection refused"), map[string]any{"order_id": 42})
 
-	time.Sleep(50 * time.Millisecond)
+	Wait()
 
 	mu.Lock()
 	defer mu.Unlock()
@@ -111,7 +132,7 @@ func TestAuthHeader(t *testing.T) {
 	Log("Test", nil)
 	Flush()
 
-	time.Sleep(50 * time.Millisecond)
+	Wait()
 
 	if authHeader != "Bearer my-secret-key" {
 		t.Errorf("expected auth header 'Bearer my-secret-key', got '%s'", authHeader)
@@ -154,7 +175,7 @@ func TestMiddlewareGeneratesTraceID(t *testing.T) {
 	}
 
 	Flush()
-	time.Sleep(50 * time.Millisecond)
+	Wait()
 
 	mu.Lock()
 	defer mu.Unlock()
@@ -210,7 +231,7 @@ func TestMiddlewareUsesIncomingTraceID(t *testing.T) {
 	}
 
 	Flush()
-	time.Sleep(50 * time.Millisecond)
+	Wait()
 
 	mu.Lock()
 	defer mu.Unlock()
@@ -221,3 +242,3923 @@ func TestMiddlewareUsesIncomingTraceID(t *testing.T) {
 		t.Errorf("expected trace_id 'incoming-trace', got %v", event["trace_id"])
 	}
 }
+
+func TestSharedSenderMergesHandlers(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key")
+	billing := slog.New(sender.NewHandler()).With("module", "billing")
+	auth := slog.New(sender.NewHandler()).With("module", "auth")
+
+	billing.Info("Invoice created")
+	auth.Info("User logged in")
+	sender.Flush()
+
+	sender.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+
+	events := received[0]["events"].([]any)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events in batch, got %d", len(events))
+	}
+	first := events[0].(map[string]any)["context"].(map[string]any)
+	second := events[1].(map[string]any)["context"].(map[string]any)
+	if first["module"] != "billing" || second["module"] != "auth" {
+		t.Errorf("expected per-handler attrs billing/auth, got %v/%v", first["module"], second["module"])
+	}
+}
+
+func TestFlushN(t *testing.T) {
+	var status atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch status.Load() {
+		case 207:
+			w.WriteHeader(207)
+			w.Write([]byte(`{"results":[{"status":202},{"status":500},{"status":202},{"status":202},{"status":500}]}`))
+		case 503:
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	h := NewSender(server.URL, "test-key").NewHandler()
+	logger := slog.New(h)
+	logBatch := func() {
+		for i := range 5 {
+			logger.Info("event", "i", i)
+		}
+	}
+
+	logBatch()
+	if n, err := h.FlushN(); n != 5 || err != nil {
+		t.Errorf("expected 5 delivered and no error, got %d, %v", n, err)
+	}
+
+	status.Store(207)
+	logBatch()
+	if n, err := h.FlushN(); n != 3 || err != nil {
+		t.Errorf("expected 3 of 5 accepted on partial success, got %d, %v", n, err)
+	}
+
+	status.Store(503)
+	if n, err := h.FlushN(); n != 0 || !errors.Is(err, ErrServer) {
+		t.Errorf("expected nothing delivered and a server error, got %d, %v", n, err)
+	}
+}
+
+func TestPartialSuccessRetriesRejected(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		first := len(received) == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(207)
+			w.Write([]byte(`{"results":[{"status":202},{"status":202},{"status":500}]}`))
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key")
+	sender.Log("first", nil)
+	sender.Log("second", nil)
+	sender.Log("third", nil)
+	sender.Flush()
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(received))
+	}
+	retried := received[1]["events"].([]any)
+	if len(retried) != 1 {
+		t.Fatalf("expected 1 retried event, got %d", len(retried))
+	}
+	if msg := retried[0].(map[string]any)["message"]; msg != "third" {
+		t.Errorf("expected rejected event 'third' to be retried, got %v", msg)
+	}
+	if stats := sender.Stats(); stats.Sent != 3 {
+		t.Errorf("expected 3 sent after retry, got %d", stats.Sent)
+	}
+}
+
+func TestBufferErrors(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", BufferErrors(true))
+	sender.Error("Payment declined", fmt.Errorf("card expired"), nil)
+	sender.Error("Payment declined", fmt.Errorf("insufficient funds"), nil)
+	sender.Error("Refund failed", fmt.Errorf("timeout"), nil)
+
+	sender.Wait()
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	if events := received[0]["events"].([]any); len(events) != 3 {
+		t.Errorf("expected 3 errors in one batch, got %d", len(events))
+	}
+}
+
+func TestBeforeSend(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", BeforeSend(func(e Event) (Event, bool) {
+		if e.Message == "health check" {
+			return e, false
+		}
+		e.Message = "[api] " + e.Message
+		return e, true
+	}))
+	sender.Log("health check", nil)
+	sender.Log("User signed up", nil)
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	events := received[0]["events"].([]any)
+	if len(events) != 1 {
+		t.Fatalf("expected dropped event to be removed, got %d events", len(events))
+	}
+	if msg := events[0].(map[string]any)["message"]; msg != "[api] User signed up" {
+		t.Errorf("expected mutated message, got %v", msg)
+	}
+}
+
+func TestEventJSONContract(t *testing.T) {
+	r := slog.NewRecord(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), slog.LevelInfo, "User signed up", 0)
+	r.AddAttrs(slog.Int("user_id", 123))
+	e := NewEvent(r)
+	e.TraceID = "abc123"
+	e.DurationMS = 42
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data map[string]any
+	json.Unmarshal(body, &data)
+
+	expected := map[string]any{
+		"level":       "INFO",
+		"message":     "User signed up",
+		"timestamp":   "2024-03-01T12:00:00Z",
+		"duration_ms": float64(42),
+		"trace_id":    "abc123",
+	}
+	for k, v := range expected {
+		if data[k] != v {
+			t.Errorf("expected %s=%v, got %v", k, v, data[k])
+		}
+	}
+	ctx, ok := data["context"].(map[string]any)
+	if !ok || ctx["user_id"] != float64(123) {
+		t.Errorf("expected context.user_id 123, got %v", data["context"])
+	}
+	if len(data) != 6 {
+		t.Errorf("expected exactly 6 fields, got %v", data)
+	}
+}
+
+func TestRecoveryDrainsBacklog(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+	var outage atomic.Bool
+	outage.Store(true)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if outage.Load() {
+			panic(http.ErrAbortHandler)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key")
+	for i := 0; i < 3; i++ {
+		sender.Error("Queued during outage", fmt.Errorf("err %d", i), nil)
+	}
+	for deadline := time.Now().Add(time.Second); sender.Stats().Buffered < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 buffered events during outage, got %d", sender.Stats().Buffered)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	outage.Store(false)
+	sender.Error("First after recovery", fmt.Errorf("boom"), nil)
+
+	sender.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	total := 0
+	for _, data := range received {
+		total += len(data["events"].([]any))
+	}
+	if total != 4 {
+		t.Errorf("expected all 4 events delivered promptly after recovery, got %d", total)
+	}
+	if buffered := sender.Stats().Buffered; buffered != 0 {
+		t.Errorf("expected empty buffer after recovery, got %d", buffered)
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	var received []map[string]any
+	var acceptEncoding string
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		first := len(received) == 1
+		mu.Unlock()
+		if !first {
+			w.WriteHeader(200)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(207)
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(`{"results":[{"status":500},{"status":202}]}`))
+		zw.Close()
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key")
+	sender.Log("rejected", nil)
+	sender.Log("accepted", nil)
+	sender.Flush()
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if acceptEncoding != "gzip" {
+		t.Errorf("expected Accept-Encoding gzip, got %q", acceptEncoding)
+	}
+	if len(received) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(received))
+	}
+	retried := received[1]["events"].([]any)
+	if len(retried) != 1 || retried[0].(map[string]any)["message"] != "rejected" {
+		t.Errorf("expected only 'rejected' to be retried, got %v", retried)
+	}
+}
+
+func TestShutdownAllFlushesEverySender(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		received.Add(int32(len(data.Events)))
+	}))
+	defer server.Close()
+
+	// Track only this test's Senders.
+	live.Lock()
+	saved := live.senders
+	live.senders = make(map[weak.Pointer[Sender]]struct{})
+	live.Unlock()
+	defer func() {
+		live.Lock()
+		live.senders = saved
+		live.Unlock()
+	}()
+
+	a, b := NewSender(server.URL, "test-key"), NewSender(server.URL, "test-key")
+	a.Log("from a", nil)
+	b.Log("from b", nil)
+	shutdownAll()
+	if n := received.Load(); n != 2 {
+		t.Errorf("expected both Senders flushed on shutdown, got %d events", n)
+	}
+}
+
+func TestShutdownDeliversWithinGrace(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", ShutdownGrace(time.Second))
+	sender.Log("Last words", nil)
+
+	if err := sender.shutdown(); err != nil {
+		t.Fatalf("expected delivery within grace, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request before shutdown returned, got %d", len(received))
+	}
+}
+
+func TestShutdownBoundedByGrace(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sender := NewSender(server.URL, "test-key", ShutdownGrace(100*time.Millisecond))
+	sender.Log("Never acknowledged", nil)
+
+	start := time.Now()
+	if err := sender.shutdown(); err == nil {
+		t.Error("expected an error when the grace period expires")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected shutdown to return within grace, took %v", elapsed)
+	}
+}
+
+func TestMiddlewarePathNormalizer(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", PathNormalizer(func(r *http.Request) string {
+		parts := strings.Split(r.URL.Path, "/")
+		for i, p := range parts {
+			if _, err := strconv.Atoi(p); err == nil {
+				parts[i] = ":id"
+			}
+		}
+		return strings.Join(parts, "/")
+	}))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	req := httptest.NewRequest("GET", "/users/123/orders/456", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	event := received[0]["events"].([]any)[0].(map[string]any)
+	ctx := event["context"].(map[string]any)
+	if ctx["path"] != "/users/:id/orders/:id" {
+		t.Errorf("expected normalized path, got %v", ctx["path"])
+	}
+	if event["message"] != "GET /users/:id/orders/:id → 200" {
+		t.Errorf("expected normalized path in message, got %v", event["message"])
+	}
+}
+
+func TestMiddlewareRoutePattern(t *testing.T) {
+	sender := NewSender("", "test-key")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {})
+	handler := sender.Middleware(mux)
+
+	for _, path := range []string{"/users/42", "/static/app.css", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	events := sender.Snapshot()
+	for i, want := range []string{"/users/{id}", "/static/", "/missing"} {
+		if got := events[i].Context["route"]; got != want {
+			t.Errorf("expected route %q, got %v", want, got)
+		}
+	}
+	if events[0].Message != "GET /users/{id} → 200" || events[0].Context["path"] != "/users/42" {
+		t.Errorf("expected the pattern in the message and the raw path kept, got %q %v", events[0].Message, events[0].Context["path"])
+	}
+}
+
+func TestAddRequestAttr(t *testing.T) {
+	sender := NewSender("", "test-key")
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddRequestAttr(r.Context(), "user_id", 42)
+		AddRequestAttr(r.Context(), "status", "ignored")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil))
+
+	e := sender.Snapshot()[0]
+	if e.Context["user_id"] != int64(42) || e.Context["status"] != 200 {
+		t.Errorf("expected the handler's attr on the request event, got %v", e.Context)
+	}
+	AddRequestAttr(context.Background(), "unused", true) // no middleware: no-op
+}
+
+func TestLogRequestStart(t *testing.T) {
+	sender := NewSender("", "test-key", LogRequestStart(true), SkipPaths("/healthz"))
+	during := -1
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if during < 0 {
+			during = len(sender.Snapshot())
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/events", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+
+	events := sender.Snapshot()
+	if during != 1 || len(events) != 2 {
+		t.Fatalf("expected a start event during the request and a finish event after, got %d then %d", during, len(events))
+	}
+	start, finish := events[0], events[1]
+	if start.Message != "GET /events started" || start.Context["phase"] != "started" {
+		t.Errorf("expected a started event, got %q %v", start.Message, start.Context)
+	}
+	if finish.Message != "GET /events → 200" {
+		t.Errorf("expected the completion event, got %q", finish.Message)
+	}
+	if start.TraceID == "" || start.TraceID != finish.TraceID {
+		t.Errorf("expected both events to share a trace ID, got %q and %q", start.TraceID, finish.TraceID)
+	}
+}
+
+func TestMiddlewareRecoversPanic(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", RecoverPanics(true))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("nil map write")
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/checkout", nil))
+
+	if rr.Code != 500 {
+		t.Errorf("expected 500 response, got %d", rr.Code)
+	}
+
+	sender.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	event := received[0]["events"].([]any)[0].(map[string]any)
+	if event["message"] != "panic: nil map write" {
+		t.Errorf("expected panic message, got %v", event["message"])
+	}
+	ctx := event["context"].(map[string]any)
+	if stack, _ := ctx["stack_trace"].(string); !strings.Contains(stack, "TestMiddlewareRecoversPanic") {
+		t.Errorf("expected stack trace through the panicking handler, got %q", stack)
+	}
+	if ctx["status"] != float64(500) {
+		t.Errorf("expected status 500 in context, got %v", ctx["status"])
+	}
+}
+
+func TestMiddlewarePanicWithError(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", RecoverPanics(true))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(fmt.Errorf("checkout: %w", &queryError{table: "orders"}))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/checkout", nil))
+	sender.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	ctx := received[0]["events"].([]any)[0].(map[string]any)["context"].(map[string]any)
+	if ctx["error_type"] != "lognorth.queryError" {
+		t.Errorf("expected error_type lognorth.queryError, got %v", ctx["error_type"])
+	}
+	if chain, _ := ctx["error_chain"].([]any); len(chain) != 2 {
+		t.Errorf("expected 2 layers in error_chain, got %v", ctx["error_chain"])
+	}
+}
+
+func TestMiddlewareFlusher(t *testing.T) {
+	var deadlineErr error
+	sender := NewSender("", "test-key")
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("expected the middleware writer to implement http.Flusher")
+		}
+		w.Write([]byte("data: 1\n\n"))
+		f.Flush()
+		deadlineErr = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Second))
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/events", nil))
+	if !rr.Flushed {
+		t.Error("expected Flush to reach the wrapped writer")
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if deadlineErr != nil {
+		t.Errorf("expected ResponseController to reach the server's writer, got %v", deadlineErr)
+	}
+}
+
+type queryError struct{ table string }
+
+func (e *queryError) Error() string { return "query failed on " + e.table }
+
+func TestErrorChain(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key")
+	err := fmt.Errorf("load user: %w", &queryError{table: "users"})
+	slog.New(sender.NewHandler()).Error("Profile failed", "error", err)
+
+	sender.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	ctx := received[0]["events"].([]any)[0].(map[string]any)["context"].(map[string]any)
+	chain, _ := ctx["error_chain"].([]any)
+	if len(chain) != 2 {
+		t.Fatalf("expected 2 layers in error_chain, got %v", ctx["error_chain"])
+	}
+	outer := chain[0].(map[string]any)
+	inner := chain[1].(map[string]any)
+	if outer["message"] != "load user: query failed on users" {
+		t.Errorf("expected outer layer message, got %v", outer["message"])
+	}
+	if inner["message"] != "query failed on users" || inner["type"] != "lognorth.queryError" {
+		t.Errorf("expected inner queryError layer, got %v", inner)
+	}
+	if ctx["error_type"] != "lognorth.queryError" {
+		t.Errorf("expected error_type lognorth.queryError, got %v", ctx["error_type"])
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	sender := NewSender(server.URL, "test-key", DryRun(&out))
+	sender.Log("User signed up", map[string]any{"user_id": 123})
+	sender.Flush()
+
+	if requests != 0 {
+		t.Errorf("expected no HTTP requests in dry run, got %d", requests)
+	}
+	line := out.String()
+	if !strings.HasPrefix(line, "POST "+server.URL+"/api/v1/events/batch ") {
+		t.Fatalf("expected request line in dry-run output, got %q", line)
+	}
+	var data map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "POST "+server.URL+"/api/v1/events/batch ")), &data); err != nil {
+		t.Fatalf("expected serialized batch, got %q: %v", line, err)
+	}
+	if msg := data["events"].([]any)[0].(map[string]any)["message"]; msg != "User signed up" {
+		t.Errorf("expected message in dry-run batch, got %v", msg)
+	}
+}
+
+func TestFlushIntervalFactors(t *testing.T) {
+	var status atomic.Int32
+	status.Store(429)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key",
+		BackoffMultiplier(3),
+		RecoveryFactor(0.5),
+		MaxFlushInterval(20*time.Second),
+	)
+	flush := func() {
+		sender.mu.Lock()
+		sender.backoff = time.Time{}
+		sender.mu.Unlock()
+		sender.Log("tick", nil)
+		sender.Flush()
+	}
+
+	steps := []struct {
+		status int
+		want   time.Duration
+	}{
+		{429, 15 * time.Second},
+		{429, 20 * time.Second},
+		{200, 10 * time.Second},
+		{200, 5 * time.Second},
+		{200, 5 * time.Second},
+	}
+	for i, step := range steps {
+		status.Store(int32(step.status))
+		flush()
+		if got := sender.Stats().FlushInterval; got != step.want {
+			t.Errorf("step %d (%d): expected interval %v, got %v", i, step.status, step.want, got)
+		}
+	}
+}
+
+func TestOnDelivered(t *testing.T) {
+	var sentIDs []string
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		for _, e := range data["events"].([]any) {
+			sentIDs = append(sentIDs, e.(map[string]any)["id"].(string))
+		}
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	var deliveredIDs []string
+	sender := NewSender(server.URL, "test-key", OnDelivered(func(ids []string) {
+		deliveredIDs = append(deliveredIDs, ids...)
+	}))
+	sender.Log("first", nil)
+	sender.Log("second", nil)
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(sentIDs) != 2 || sentIDs[0] == "" || sentIDs[0] == sentIDs[1] {
+		t.Fatalf("expected 2 distinct event IDs in payload, got %v", sentIDs)
+	}
+	if strings.Join(deliveredIDs, ",") != strings.Join(sentIDs, ",") {
+		t.Errorf("expected delivered IDs %v, got %v", sentIDs, deliveredIDs)
+	}
+}
+
+func TestMiddlewareDetachedFromSlowIngest(t *testing.T) {
+	release := make(chan struct{})
+	ingest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ingest.Close()
+	defer close(release)
+
+	sender := NewSender(ingest.URL, "test-key", RecoverPanics(true), ErrorSendTimeout(50*time.Millisecond))
+	app := httptest.NewServer(sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+	defer app.Close()
+
+	start := time.Now()
+	resp, err := http.Get(app.URL + "/checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected the response without waiting on ingest, took %v", elapsed)
+	}
+	if resp.StatusCode != 500 {
+		t.Errorf("expected 500, got %d", resp.StatusCode)
+	}
+
+	// The error send gives up on its own budget rather than hanging.
+	done := make(chan struct{})
+	go func() { sender.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the error send to stop at ErrorSendTimeout")
+	}
+	if stats := sender.Stats(); stats.TransportErrors != 1 {
+		t.Errorf("expected the timed-out send counted as a transport error, got %+v", stats)
+	}
+}
+
+func TestMiddlewareCustomTraceHeader(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", TraceHeader("X-Request-ID"))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("X-Request-ID", "edge-123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Header().Get("X-Request-ID") != "edge-123" {
+		t.Errorf("expected X-Request-ID 'edge-123', got '%s'", rr.Header().Get("X-Request-ID"))
+	}
+	if rr.Header().Get("X-Trace-ID") != "" {
+		t.Errorf("expected no X-Trace-ID header, got '%s'", rr.Header().Get("X-Trace-ID"))
+	}
+
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	event := received[0]["events"].([]any)[0].(map[string]any)
+	if event["trace_id"] != "edge-123" {
+		t.Errorf("expected trace_id 'edge-123', got %v", event["trace_id"])
+	}
+}
+
+func TestMiddlewareTraceIDGenerator(t *testing.T) {
+	sender := NewSender("", "test-key", TraceIDGenerator(func() string { return "01J9ZQ8X4M-custom" }))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+
+	if got := rr.Header().Get("X-Trace-ID"); got != "01J9ZQ8X4M-custom" {
+		t.Errorf("expected generated ID echoed in X-Trace-ID, got %q", got)
+	}
+	if got := sender.Snapshot()[0].TraceID; got != "01J9ZQ8X4M-custom" {
+		t.Errorf("expected generated trace_id on the event, got %q", got)
+	}
+}
+
+type chiRequestIDKey struct{}
+
+func TestMiddlewareRequestIDFromContext(t *testing.T) {
+	sender := NewSender("", "test-key", RequestIDFromContext(func(ctx context.Context) string {
+		id, _ := ctx.Value(chiRequestIDKey{}).(string)
+		return id
+	}))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tagged" {
+			r = r.WithContext(context.WithValue(r.Context(), chiRequestIDKey{}, "host/abc-000001"))
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	rr := httptest.NewRecorder()
+	upstream.ServeHTTP(rr, httptest.NewRequest("GET", "/tagged", nil))
+	upstream.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/plain", nil))
+
+	events := sender.Snapshot()
+	if events[0].TraceID != "host/abc-000001" || rr.Header().Get("X-Trace-ID") != "host/abc-000001" {
+		t.Errorf("expected the context request ID as trace_id, got %q", events[0].TraceID)
+	}
+	if id := events[1].TraceID; len(id) != 16 {
+		t.Errorf("expected a generated trace ID without one in context, got %q", id)
+	}
+}
+
+func TestMiddlewareSlowRequest(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", SlowRequestThreshold(20*time.Millisecond))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(40 * time.Millisecond)
+		}
+		w.WriteHeader(200)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	events := received[0]["events"].([]any)
+	fast := events[0].(map[string]any)
+	slow := events[1].(map[string]any)
+	if fast["level"] != "INFO" || fast["context"].(map[string]any)["slow"] != nil {
+		t.Errorf("expected fast request at INFO without slow flag, got %v", fast)
+	}
+	if slow["level"] != "WARN" {
+		t.Errorf("expected slow request escalated to WARN, got %v", slow["level"])
+	}
+	if slow["context"].(map[string]any)["slow"] != true {
+		t.Errorf("expected slow: true in context, got %v", slow["context"])
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	h := NewSender("http://localhost", "test-key").NewHandler()
+	logger := slog.New(h)
+	logger.Info("one", "n", 1)
+	logger.Info("two", "n", 2)
+	logger.Info("three", "n", 3)
+
+	snap := h.Snapshot()
+	if len(snap) != 3 {
+		t.Fatalf("expected 3 events in snapshot, got %d", len(snap))
+	}
+	if snap[0].Message != "one" || snap[2].Message != "three" {
+		t.Errorf("expected events in order, got %q..%q", snap[0].Message, snap[2].Message)
+	}
+
+	snap[0].Context["n"] = 99
+	if again := h.Snapshot(); len(again) != 3 || again[0].Context["n"] != int64(1) {
+		t.Errorf("expected snapshot to leave buffer intact, got %v", again)
+	}
+}
+
+func TestMaxEventAge(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sender := NewSender(server.URL, "test-key", MaxEventAge(time.Hour))
+	sender.now = func() time.Time { return now }
+
+	sender.Log("stale", nil)
+	now = now.Add(90 * time.Minute)
+	sender.Log("fresh", nil)
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	events := received[0]["events"].([]any)
+	if len(events) != 1 || events[0].(map[string]any)["message"] != "fresh" {
+		t.Errorf("expected only the fresh event, got %v", events)
+	}
+	if stats := sender.Stats(); stats.Expired != 1 || stats.Dropped != 0 {
+		t.Errorf("expected 1 expired and 0 dropped, got %+v", stats)
+	}
+}
+
+func TestFlushErrors(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	h := NewSender(server.URL, "test-key", BufferErrors(true)).NewHandler()
+	logger := slog.New(h)
+	logger.Info("Cache warmed")
+	logger.Error("Charge failed", "error", fmt.Errorf("card declined"))
+	logger.Info("User signed up")
+
+	h.FlushErrors()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	events := received[0]["events"].([]any)
+	if len(events) != 1 || events[0].(map[string]any)["message"] != "Charge failed" {
+		t.Errorf("expected only the error event, got %v", events)
+	}
+	pending := h.Snapshot()
+	if len(pending) != 2 || pending[0].Message != "Cache warmed" || pending[1].Message != "User signed up" {
+		t.Errorf("expected info events to stay buffered, got %v", pending)
+	}
+}
+
+func TestChunkedBacklog(t *testing.T) {
+	var sizes []int
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		sizes = append(sizes, len(data["events"].([]any)))
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", BatchSize(100))
+	sender.mu.Lock()
+	for i := 0; i < 1000; i++ {
+		sender.buffer = append(sender.buffer, Event{Message: fmt.Sprintf("event %d", i), Timestamp: time.Now().UTC().Format(time.RFC3339)})
+	}
+	sender.mu.Unlock()
+
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(sizes) != 10 {
+		t.Fatalf("expected 10 chunked requests, got %d", len(sizes))
+	}
+	for i, n := range sizes {
+		if n != 100 {
+			t.Errorf("chunk %d: expected 100 events, got %d", i, n)
+		}
+	}
+	if stats := sender.Stats(); stats.Sent != 1000 || stats.Buffered != 0 {
+		t.Errorf("expected 1000 sent and empty buffer, got %+v", stats)
+	}
+}
+
+func TestChunkedBacklogStopsOnFailure(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 2 {
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", BatchSize(10), MaxBatchBytes(1000))
+	sender.mu.Lock()
+	for i := 0; i < 50; i++ {
+		sender.buffer = append(sender.buffer, Event{Message: fmt.Sprintf("event %d", i), Context: map[string]any{"pad": strings.Repeat("x", 100)}})
+	}
+	sender.mu.Unlock()
+
+	if err := sender.FlushContext(context.Background()); err == nil {
+		t.Fatal("expected an error from the failed chunk")
+	}
+	if requests.Load() != 2 {
+		t.Errorf("expected to stop after the failed chunk, got %d requests", requests.Load())
+	}
+	// Two chunks went out; MaxBatchBytes keeps each under BatchSize.
+	pending := sender.Snapshot()
+	if len(pending) <= 30 || len(pending) >= 50 {
+		t.Fatalf("expected byte-capped chunks to leave more than 30 events buffered, got %d", len(pending))
+	}
+	for i := range pending {
+		if pending[i].Message != fmt.Sprintf("event %d", 50-len(pending)+i) {
+			t.Errorf("expected remainder in order, got %q at %d", pending[i].Message, i)
+			break
+		}
+	}
+}
+
+func TestIncludeBuildInfo(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", IncludeBuildInfo(true))
+	sender.Log("Started", nil)
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	meta, ok := received[0]["meta"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected meta object in batch, got %v", received[0])
+	}
+	if v, _ := meta["go_version"].(string); !strings.HasPrefix(v, "go") {
+		t.Errorf("expected go_version in meta, got %v", meta["go_version"])
+	}
+	if _, ok := received[0]["events"].([]any)[0].(map[string]any)["context"]; ok {
+		t.Error("expected build info at batch level, not on events")
+	}
+}
+
+func TestIncludeBatchCounts(t *testing.T) {
+	var meta any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]any
+		json.NewDecoder(r.Body).Decode(&data)
+		meta = data["meta"]
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", IncludeBatchCounts(true), BufferErrors(true), BatchSize(100))
+	logger := slog.New(sender.NewHandler())
+	for range 3 {
+		logger.Info("ok")
+	}
+	logger.Warn("slow")
+	sender.Error("failed", errors.New("boom"), nil)
+	sender.Error("failed again", errors.New("boom"), nil)
+	sender.Flush()
+
+	want := map[string]any{"counts": map[string]any{"info": 3.0, "warn": 1.0, "error": 2.0}}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("expected per-level counts %v, got %v", want, meta)
+	}
+}
+
+func BenchmarkSendPooling(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name string
+		opt  Option
+	}{
+		{"pooled", MaxIdleConns(16)},
+		{"fresh-connection", HTTPClient(&http.Client{Transport: &http.Transport{DisableKeepAlives: true}})},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			sender := NewSender(server.URL, "test-key", c.opt)
+			batch := make([]Event, 10)
+			for i := range batch {
+				batch[i] = Event{Message: "bench", Timestamp: "2024-03-01T12:00:00Z"}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sender.send(context.Background(), batch, false)
+			}
+		})
+	}
+}
+
+func newHTTP2Server(h http.HandlerFunc) (*httptest.Server, Option) {
+	server := httptest.NewUnstartedServer(h)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return server, TLSConfig(&tls.Config{RootCAs: pool})
+}
+
+func TestUseHTTP2(t *testing.T) {
+	var proto atomic.Value
+	server, trust := newHTTP2Server(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+	})
+	defer server.Close()
+
+	for _, tt := range []struct {
+		enabled bool
+		want    string
+	}{{true, "HTTP/2.0"}, {false, "HTTP/1.1"}} {
+		sender := NewSender(server.URL, "test-key", trust, UseHTTP2(tt.enabled))
+		sender.Log("hello", nil)
+		if err := sender.FlushContext(context.Background()); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		if got := proto.Load(); got != tt.want {
+			t.Errorf("UseHTTP2(%v): expected %s, got %v", tt.enabled, tt.want, got)
+		}
+	}
+}
+
+func BenchmarkHTTP2Throughput(b *testing.B) {
+	server, trust := newHTTP2Server(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+	defer server.Close()
+
+	for _, enabled := range []bool{false, true} {
+		name := "http1"
+		if enabled {
+			name = "http2"
+		}
+		b.Run(name, func(b *testing.B) {
+			sender := NewSender(server.URL, "test-key", trust, UseHTTP2(enabled), MaxIdleConns(64))
+			batch := make([]Event, 100)
+			for i := range batch {
+				batch[i] = Event{Message: "bench", Timestamp: "2024-03-01T12:00:00Z"}
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				events := slices.Clone(batch)
+				for pb.Next() {
+					sender.send(context.Background(), events, false)
+				}
+			})
+			b.ReportMetric(float64(b.N*len(batch))/b.Elapsed().Seconds(), "events/s")
+		})
+	}
+}
+
+func TestOverflowWriter(t *testing.T) {
+	var overflow bytes.Buffer
+	sender := NewSender("", "test-key", MaxBufferSize(2), BatchSize(100), OverflowWriter(&overflow))
+	sender.Log("first", map[string]any{"n": 1})
+	sender.Log("second", nil)
+	sender.Log("third", nil)
+
+	var dropped Event
+	if err := json.Unmarshal(overflow.Bytes(), &dropped); err != nil {
+		t.Fatalf("expected dropped event as JSON, got %q: %v", overflow.String(), err)
+	}
+	if dropped.Message != "first" || dropped.Context["n"] != float64(1) {
+		t.Errorf("expected oldest event to overflow, got %+v", dropped)
+	}
+	if stats := sender.Stats(); stats.Buffered != 2 || stats.Dropped != 1 {
+		t.Errorf("expected 2 buffered and 1 dropped, got %+v", stats)
+	}
+}
+
+func TestSetSampleRate(t *testing.T) {
+	h := NewSender("", "test-key", SampleRate(0), BatchSize(100), BufferErrors(true)).NewHandler()
+	logger := slog.New(h)
+
+	for i := 0; i < 5; i++ {
+		logger.Info("sampled out")
+	}
+	logger.Error("always kept")
+	if n := len(h.Snapshot()); n != 1 {
+		t.Fatalf("expected only the error with sample rate 0, got %d events", n)
+	}
+
+	h.SetSampleRate(1)
+	for i := 0; i < 5; i++ {
+		logger.Info("kept")
+	}
+	if n := len(h.Snapshot()); n != 1+5 {
+		t.Errorf("expected all records kept after SetSampleRate(1), got %d events", n)
+	}
+}
+
+func TestSampleSeed(t *testing.T) {
+	decisions := func(opts ...Option) []bool {
+		h := NewSender("", "test-key", append([]Option{SampleRate(0.5), BatchSize(1000)}, opts...)...).NewHandler()
+		logger := slog.New(h)
+		for i := range 200 {
+			logger.Info("tick", "i", i)
+		}
+		kept := make([]bool, 200)
+		for _, e := range h.Snapshot() {
+			kept[e.Context["i"].(int64)] = true
+		}
+		return kept
+	}
+
+	a, b := decisions(SampleSeed(7)), decisions(SampleSeed(7))
+	if !slices.Equal(a, b) {
+		t.Error("expected identical sampling decisions for the same seed")
+	}
+	if slices.Equal(a, decisions(SampleSeed(8))) {
+		t.Error("expected a different seed to make different decisions")
+	}
+}
+
+func TestSampleModeKeepFirst(t *testing.T) {
+	h := NewSender("", "test-key", SampleRate(0), WithSampleMode(KeepFirst), BatchSize(100)).NewHandler()
+	logger := slog.New(h)
+	for range 10 {
+		logger.Info("cache miss")
+		logger.Info("retrying")
+	}
+	var got []string
+	for _, e := range h.Snapshot() {
+		got = append(got, e.Message)
+	}
+	if !slices.Equal(got, []string{"cache miss", "retrying"}) {
+		t.Errorf("expected only the first of each message at rate 0, got %v", got)
+	}
+
+	// Later repeats are sampled at the rate rather than dropped outright.
+	h.SetSampleRate(1)
+	logger.Info("cache miss")
+	if n := len(h.Snapshot()); n != 3 {
+		t.Errorf("expected repeats kept at rate 1, got %d events", n)
+	}
+}
+
+func TestMessageLRUEvicts(t *testing.T) {
+	var seen messageLRU
+	seen.firstSeen("first")
+	for i := range seenMessagesLimit {
+		seen.firstSeen(strconv.Itoa(i))
+	}
+	if !seen.firstSeen("first") {
+		t.Error("expected the least recent message evicted and seen as new again")
+	}
+	if seen.firstSeen(strconv.Itoa(seenMessagesLimit - 1)) {
+		t.Error("expected a recent message still remembered")
+	}
+}
+
+func TestErrorEndpoint(t *testing.T) {
+	var mu sync.Mutex
+	var infoMessages, errorMessages []string
+	record := func(dst *[]string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			var data map[string]any
+			json.Unmarshal(body, &data)
+			mu.Lock()
+			for _, e := range data["events"].([]any) {
+				*dst = append(*dst, e.(map[string]any)["message"].(string))
+			}
+			mu.Unlock()
+			w.WriteHeader(200)
+		}
+	}
+	infoServer := httptest.NewServer(record(&infoMessages))
+	defer infoServer.Close()
+	errorServer := httptest.NewServer(record(&errorMessages))
+	defer errorServer.Close()
+
+	sender := NewSender(infoServer.URL, "test-key", ErrorEndpoint(errorServer.URL))
+	sender.Log("User signed up", nil)
+	sender.Error("Checkout failed", fmt.Errorf("connection refused"), nil)
+	sender.Flush()
+
+	sender.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(infoMessages) != 1 || infoMessages[0] != "User signed up" {
+		t.Errorf("expected info event on Endpoint, got %v", infoMessages)
+	}
+	if len(errorMessages) != 1 || errorMessages[0] != "Checkout failed" {
+		t.Errorf("expected error event on ErrorEndpoint, got %v", errorMessages)
+	}
+}
+
+type tenantKey struct{}
+
+func TestContextExtractors(t *testing.T) {
+	h := NewSender("", "test-key",
+		ContextExtractor(func(ctx context.Context) []slog.Attr {
+			tenant, _ := ctx.Value(tenantKey{}).(string)
+			return []slog.Attr{slog.String("tenant", tenant), slog.String("plan", "free")}
+		}),
+		ContextExtractor(func(ctx context.Context) []slog.Attr {
+			return []slog.Attr{slog.String("plan", "pro")}
+		}),
+	).NewHandler()
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	slog.New(h).InfoContext(ctx, "Report generated")
+
+	events := h.Snapshot()
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Context["tenant"] != "acme" {
+		t.Errorf("expected tenant from first extractor, got %v", events[0].Context["tenant"])
+	}
+	if events[0].Context["plan"] != "pro" {
+		t.Errorf("expected second extractor to override plan, got %v", events[0].Context["plan"])
+	}
+}
+
+type requestUserKey struct{}
+
+func TestRegisterContextKey(t *testing.T) {
+	RegisterContextKey(requestUserKey{}, "user")
+	RegisterContextKey(requestUserKey{}, "user_id")
+
+	h := NewSender("", "test-key").NewHandler()
+	logger := slog.New(h)
+	logger.InfoContext(context.WithValue(context.Background(), requestUserKey{}, 42), "Report generated")
+	logger.Info("No user")
+
+	events := h.Snapshot()
+	if events[0].Context["user_id"] != int64(42) || events[0].Context["user"] != nil {
+		t.Errorf("expected the value under the latest field name user_id, got %v", events[0].Context)
+	}
+	if _, ok := events[1].Context["user_id"]; ok {
+		t.Errorf("expected no field when the key is absent, got %v", events[1].Context)
+	}
+}
+
+func TestLevelFields(t *testing.T) {
+	h := NewSender("", "test-key", BufferErrors(true), LevelFields(map[slog.Level][]slog.Attr{
+		slog.LevelWarn:  {slog.String("host", "web-1")},
+		slog.LevelError: {slog.String("build", "abc123")},
+	})).NewHandler()
+	logger := slog.New(h)
+	logger.Info("lean")
+	logger.Warn("warned")
+	logger.Error("failed", "error", errors.New("boom"))
+
+	events := h.Snapshot()
+	if events[0].Context != nil {
+		t.Errorf("expected no extra fields on info, got %v", events[0].Context)
+	}
+	if events[1].Context["host"] != "web-1" || events[1].Context["build"] != nil {
+		t.Errorf("expected only the warn fields on warn, got %v", events[1].Context)
+	}
+	if events[2].Context["host"] != "web-1" || events[2].Context["build"] != "abc123" {
+		t.Errorf("expected warn and error fields on error, got %v", events[2].Context)
+	}
+}
+
+func TestIncludeK8sMetadata(t *testing.T) {
+	t.Setenv("POD_NAME", "api-7d9f")
+	t.Setenv("POD_NAMESPACE", "prod")
+	t.Setenv("MY_NODE", "node-3")
+
+	sender := NewSender("", "test-key", IncludeK8sMetadata(true), K8sEnvVars("POD_NAME", "POD_NAMESPACE", "MY_NODE"))
+	sender.Log("Started", nil)
+
+	ctx := sender.Snapshot()[0].Context
+	if ctx["k8s_pod"] != "api-7d9f" || ctx["k8s_namespace"] != "prod" || ctx["k8s_node"] != "node-3" {
+		t.Errorf("expected pod metadata on event, got %v", ctx)
+	}
+}
+
+func TestContentEventID(t *testing.T) {
+	sender := NewSender("", "test-key")
+	sender.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+	sender.Log("Job retried", map[string]any{"job": "sync", "attempt": 2})
+	sender.Log("Job retried", map[string]any{"attempt": 2, "job": "sync"})
+	sender.Log("Job retried", map[string]any{"job": "sync", "attempt": 3})
+
+	events := sender.Snapshot()
+	if events[0].ID == "" || events[0].ID != events[1].ID {
+		t.Errorf("expected identical events to share an ID, got %q and %q", events[0].ID, events[1].ID)
+	}
+	if events[0].ID == events[2].ID {
+		t.Errorf("expected different context to change the ID, both %q", events[0].ID)
+	}
+}
+
+func TestEventIDFunc(t *testing.T) {
+	sender := NewSender("", "test-key", EventIDFunc(func(e Event) string { return "custom-" + e.Message }))
+	sender.Log("one", nil)
+	if id := sender.Snapshot()[0].ID; id != "custom-one" {
+		t.Errorf("expected ID from EventIDFunc, got %q", id)
+	}
+}
+
+func TestMiddlewareCaptureHeaders(t *testing.T) {
+	sender := NewSender("", "test-key", CaptureHeaders("user-agent", "X-Tenant"))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	headers, ok := sender.Snapshot()[0].Context["headers"].(map[string]any)
+	if !ok {
+		t.Fatal("expected headers object in context")
+	}
+	if headers["User-Agent"] != "curl/8.0" || headers["X-Tenant"] != "acme" {
+		t.Errorf("expected allowlisted headers, got %v", headers)
+	}
+	if _, ok := headers["Authorization"]; ok || len(headers) != 2 {
+		t.Errorf("expected Authorization to be excluded, got %v", headers)
+	}
+}
+
+func TestFlushDeadlineFollowsOldestEvent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(207)
+		w.Write([]byte(`{"results":[{"status":500}]}`))
+	}))
+	defer server.Close()
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	sender := NewSender(server.URL, "test-key")
+	sender.now = func() time.Time { return now }
+	deadline := func() time.Time {
+		sender.mu.Lock()
+		defer sender.mu.Unlock()
+		return sender.deadline
+	}
+
+	sender.Log("oldest", nil)
+	if got := deadline(); !got.Equal(t0.Add(5 * time.Second)) {
+		t.Fatalf("expected deadline at first event + interval, got %v", got)
+	}
+
+	// A partial flush requeues the oldest event; its deadline must not reset.
+	now = t0.Add(time.Second)
+	sender.Flush()
+	if got := deadline(); !got.Equal(t0.Add(5 * time.Second)) {
+		t.Errorf("expected requeued event to keep its deadline, got %v", got)
+	}
+
+	now = t0.Add(2 * time.Second)
+	sender.Log("newer", nil)
+	if got := deadline(); !got.Equal(t0.Add(5 * time.Second)) {
+		t.Errorf("expected a newer event not to extend the deadline, got %v", got)
+	}
+}
+
+func TestMinBatchSize(t *testing.T) {
+	var batches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		batches.Add(1)
+	}))
+	defer server.Close()
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	sender := NewSender(server.URL, "test-key", BatchSize(3), MinBatchSize(3, 1), BufferErrors(true))
+	sender.now = func() time.Time { return now }
+	deadline := func() time.Time {
+		sender.mu.Lock()
+		defer sender.mu.Unlock()
+		return sender.deadline
+	}
+
+	// A lone event waits one more interval instead of going out alone.
+	sender.Log("lonely", nil)
+	now = t0.Add(5 * time.Second)
+	sender.timedFlush()
+	if n := batches.Load(); n != 0 || sender.Stats().Buffered != 1 {
+		t.Fatalf("expected the flush deferred, got %d batches", n)
+	}
+	if got := deadline(); !got.Equal(t0.Add(10 * time.Second)) {
+		t.Errorf("expected deadline pushed one interval, got %v", got)
+	}
+	// After the last allowed deferral the timer flushes whatever is there.
+	now = t0.Add(10 * time.Second)
+	sender.timedFlush()
+	if n := batches.Load(); n != 1 || sender.Stats().Buffered != 0 {
+		t.Fatalf("expected the deferred event flushed, got %d batches", n)
+	}
+
+	// A full batch still flushes immediately.
+	for range 3 {
+		sender.Log("busy", nil)
+	}
+	sender.Wait()
+	if n := batches.Load(); n != 2 {
+		t.Errorf("expected a full batch sent at once, got %d batches", n)
+	}
+
+	// A buffered error is never held back.
+	sender.Error("boom", errors.New("boom"), nil)
+	sender.timedFlush()
+	if n := batches.Load(); n != 3 || sender.Stats().Buffered != 0 {
+		t.Errorf("expected an error event to force the flush, got %d batches", n)
+	}
+}
+
+func TestKeyResolver(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string][]string{}
+	record := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			var data map[string]any
+			json.Unmarshal(body, &data)
+			mu.Lock()
+			got[name] = append(got[name], r.Header.Get("Authorization"))
+			for _, e := range data["events"].([]any) {
+				got[name] = append(got[name], e.(map[string]any)["message"].(string))
+			}
+			mu.Unlock()
+			w.WriteHeader(200)
+		}))
+	}
+	def, acme, globex := record("default"), record("acme"), record("globex")
+	defer def.Close()
+	defer acme.Close()
+	defer globex.Close()
+
+	sender := NewSender(def.URL, "default-key", KeyResolver(func(ctx context.Context) (string, string) {
+		switch ctx.Value(tenantKey{}) {
+		case "acme":
+			return "acme-key", acme.URL
+		case "globex":
+			return "globex-key", globex.URL
+		}
+		return "", ""
+	}))
+	logger := slog.New(sender.NewHandler())
+	logger.InfoContext(context.WithValue(context.Background(), tenantKey{}, "acme"), "acme event")
+	logger.InfoContext(context.WithValue(context.Background(), tenantKey{}, "globex"), "globex event")
+	logger.Info("no tenant")
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := map[string][]string{
+		"acme":    {"Bearer acme-key", "acme event"},
+		"globex":  {"Bearer globex-key", "globex event"},
+		"default": {"Bearer default-key", "no tenant"},
+	}
+	for name, want := range expected {
+		if strings.Join(got[name], "|") != strings.Join(want, "|") {
+			t.Errorf("%s: expected %v, got %v", name, want, got[name])
+		}
+	}
+}
+
+func TestKeyResolverSpoolReplay(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string][]string{}
+	var acmeDown atomic.Bool
+	record := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if name == "acme" && acmeDown.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			var data struct{ Events []Event }
+			json.NewDecoder(r.Body).Decode(&data)
+			mu.Lock()
+			got[name] = append(got[name], r.Header.Get("Authorization"))
+			for _, e := range data.Events {
+				got[name] = append(got[name], e.Message)
+			}
+			mu.Unlock()
+		}))
+	}
+	def, acme := record("default"), record("acme")
+	defer def.Close()
+	defer acme.Close()
+
+	sender := NewSender(def.URL, "default-key", SpoolDir(t.TempDir()), KeyResolver(func(ctx context.Context) (string, string) {
+		if ctx.Value(tenantKey{}) == "acme" {
+			return "acme-key", acme.URL
+		}
+		return "", ""
+	}))
+	acmeDown.Store(true)
+	slog.New(sender.NewHandler()).InfoContext(context.WithValue(context.Background(), tenantKey{}, "acme"), "acme event")
+	sender.Flush() // 503, retried once
+	sender.Flush() // 503 again, spooled
+	if stats := sender.Stats(); stats.Spooled != 1 {
+		t.Fatalf("expected the tenant event spooled, got %+v", stats)
+	}
+
+	acmeDown.Store(false)
+	if err := sender.Replay(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got["default"]) != 0 {
+		t.Errorf("expected nothing replayed to the default endpoint, got %v", got["default"])
+	}
+	if want := "Bearer acme-key|acme event"; strings.Join(got["acme"], "|") != want {
+		t.Errorf("expected the event replayed to its tenant, got %v", got["acme"])
+	}
+}
+
+// BenchmarkHandle compares the bare fast path against the map path it
+// replaces: an extractor returning an empty group adds nothing but still
+// builds a context map, as every record did before.
+func BenchmarkHandle(b *testing.B) {
+	emptyGroup := ContextExtractor(func(context.Context) []slog.Attr { return []slog.Attr{slog.Group("empty")} })
+	cases := []struct {
+		name  string
+		opts  []Option
+		attrs []any
+	}{
+		{"baseline", []Option{emptyGroup}, nil},
+		{"no-attrs", nil, nil},
+		{"one-attr", nil, []any{"user_id", 123}},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			opts := append([]Option{BatchSize(1 << 30)}, c.opts...)
+			logger := slog.New(NewSender("", "test-key", opts...).NewHandler())
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				logger.Info("User signed up", c.attrs...)
+			}
+		})
+	}
+}
+
+func TestContentEventIDNilContext(t *testing.T) {
+	e := Event{Timestamp: "2024-03-01T12:00:00Z", Message: "bare"}
+	h := sha256.New()
+	h.Write([]byte(e.Timestamp + "\x00" + e.Message + "\x00"))
+	json.NewEncoder(h).Encode(e.Context)
+	if want := hex.EncodeToString(h.Sum(nil)[:16]); ContentEventID(e) != want {
+		t.Errorf("expected the nil-context ID to match the encoded form %s, got %s", want, ContentEventID(e))
+	}
+}
+
+func TestHandleNoAttrsOmitsContext(t *testing.T) {
+	h := NewSender("", "test-key").NewHandler()
+	slog.New(h).Info("bare")
+
+	e := h.Snapshot()[0]
+	if e.Context != nil {
+		t.Errorf("expected nil context for attr-free record, got %v", e.Context)
+	}
+	body, _ := json.Marshal(e)
+	if strings.Contains(string(body), `"context"`) {
+		t.Errorf("expected context field to be omitted, got %s", body)
+	}
+}
+
+func TestSendErrorClassification(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		status int
+		want   FailureClass
+		count  func(Stats) uint64
+	}{
+		{"transport", 0, ErrTransport, func(s Stats) uint64 { return s.TransportErrors }},
+		{"client", 400, ErrClient, func(s Stats) uint64 { return s.ClientErrors }},
+		{"server", 503, ErrServer, func(s Stats) uint64 { return s.ServerErrors }},
+		{"rate limited", 429, ErrRateLimited, func(s Stats) uint64 { return s.RateLimited }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := closed.URL
+			if tt.status != 0 {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tt.status)
+				}))
+				defer server.Close()
+				url = server.URL
+			}
+
+			var got []error
+			sender := NewSender(url, "test-key", OnError(func(err error) { got = append(got, err) }))
+			sender.Log("hello", nil)
+			err := sender.FlushContext(context.Background())
+
+			if !errors.Is(err, tt.want) {
+				t.Errorf("expected returned error to be %v, got %v", tt.want, err)
+			}
+			if len(got) != 1 || !errors.Is(got[0], tt.want) {
+				t.Fatalf("expected one OnError call with %v, got %v", tt.want, got)
+			}
+			var class FailureClass
+			if !errors.As(got[0], &class) || class != tt.want {
+				t.Errorf("expected errors.As to yield %v, got %v", tt.want, class)
+			}
+			stats := sender.Stats()
+			if tt.count(stats) != 1 || stats.Failed != 1 {
+				t.Errorf("expected class counter and Failed to be 1, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNonRetryableClientErrors(t *testing.T) {
+	for _, tt := range []struct {
+		status   int
+		requests int32
+	}{
+		{401, 1},                       // final: a bad key never succeeds
+		{400, 1},                       // final: a malformed payload never succeeds
+		{408, 1 + defaultErrorRetries}, // a timeout may
+		{500, 1 + defaultErrorRetries},
+	} {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			var got []error
+			sender := NewSender(server.URL, "test-key", OnError(func(err error) { got = append(got, err) }))
+			sender.Error("charge failed", errors.New("card declined"), nil)
+			sender.Wait()
+			for range 5 {
+				sender.Flush()
+			}
+
+			if n := requests.Load(); n != tt.requests {
+				t.Errorf("expected %d requests, got %d", tt.requests, n)
+			}
+			if len(got) == 0 || !strings.Contains(got[0].Error(), strconv.Itoa(tt.status)) {
+				t.Errorf("expected OnError with status %d, got %v", tt.status, got)
+			}
+			if stats := sender.Stats(); stats.Dropped != 1 || stats.Buffered != 0 {
+				t.Errorf("expected the event dropped once retries are spent, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestRetryCounts(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		opts     []Option
+		isError  bool
+		requests int32
+	}{
+		{"default batch", nil, false, 1 + defaultBatchRetries},
+		{"default error", nil, true, 1 + defaultErrorRetries},
+		{"batch retries", []Option{BatchRetries(0)}, false, 1},
+		{"error retries", []Option{ErrorRetries(5)}, true, 6},
+		{"batch unaffected by error retries", []Option{ErrorRetries(0), BatchRetries(2)}, false, 3},
+		{"error unaffected by batch retries", []Option{ErrorRetries(0), BatchRetries(2)}, true, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			sender := NewSender(server.URL, "test-key", tt.opts...)
+			if tt.isError {
+				sender.Error("charge failed", errors.New("card declined"), nil)
+				sender.Wait()
+			} else {
+				sender.Log("batched", nil)
+			}
+			for range 8 {
+				sender.Flush()
+			}
+			if n := requests.Load(); n != tt.requests {
+				t.Errorf("expected %d requests, got %d", tt.requests, n)
+			}
+			if stats := sender.Stats(); stats.Dropped != 1 || stats.Buffered != 0 {
+				t.Errorf("expected the event dropped once retries are spent, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	var mu sync.Mutex
+	var arrivals []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(arrivals)
+	}
+
+	delay := 20 * time.Millisecond
+	sender := NewSender(server.URL, "test-key", ErrorRetries(3), RetryDelay(delay))
+	sender.Error("charge failed", errors.New("card declined"), nil)
+	for deadline := time.Now().Add(2 * time.Second); count() < 4 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := count(); n != 4 {
+		t.Fatalf("expected 4 attempts, got %d", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// Each retry waits the delay, doubled per failed attempt.
+	for i := 1; i < len(arrivals); i++ {
+		want := delay << (i - 1)
+		if gap := arrivals[i].Sub(arrivals[i-1]); gap < want {
+			t.Errorf("expected attempt %d at least %v after the previous one, got %v", i+1, want, gap)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(420)
+			w.Write([]byte("enhance your calm"))
+		}
+	}))
+	defer server.Close()
+
+	var bodies []string
+	sender := NewSender(server.URL, "test-key", ShouldRetry(func(resp *http.Response, err error) bool {
+		if resp == nil {
+			return false
+		}
+		b, _ := io.ReadAll(resp.Body)
+		bodies = append(bodies, string(b))
+		return resp.StatusCode == 420
+	}))
+	sender.Log("calm down", nil)
+	sender.Flush()
+	if stats := sender.Stats(); stats.Buffered != 1 || stats.Dropped != 0 {
+		t.Fatalf("expected the 420 batch requeued, got %+v", stats)
+	}
+	sender.Flush()
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected the batch retried once, got %d requests", n)
+	}
+	if stats := sender.Stats(); stats.Sent != 1 || stats.Buffered != 0 {
+		t.Errorf("expected the retry delivered, got %+v", stats)
+	}
+	if len(bodies) != 1 || bodies[0] != "enhance your calm" {
+		t.Errorf("expected the predicate to read the response body, got %q", bodies)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body) // lets the server notice the client hanging up
+		if requests.Add(1) == 1 {
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", FlushTimeout(50*time.Millisecond))
+	sender.Log("slow", nil)
+	start := time.Now()
+	err := sender.autoFlush()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the auto-flush bounded by the timeout, took %v", elapsed)
+	}
+	if !errors.Is(err, ErrTransport) {
+		t.Errorf("expected a transport error, got %v", err)
+	}
+	if stats := sender.Stats(); stats.Buffered != 1 || stats.Dropped != 0 {
+		t.Fatalf("expected the abandoned batch re-buffered, got %+v", stats)
+	}
+
+	sender.Flush()
+	if stats := sender.Stats(); stats.Sent != 1 || stats.Buffered != 0 {
+		t.Errorf("expected the re-buffered event sent next time, got %+v", stats)
+	}
+
+	// A batch that keeps timing out spends its retries like any failure.
+	var stuck atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		stuck.Add(1)
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	sender = NewSender(slow.URL, "test-key", FlushTimeout(50*time.Millisecond), BatchRetries(2), RetryDelay(time.Millisecond))
+	sender.Log("slow", nil)
+	for range 5 {
+		sender.autoFlush()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := stuck.Load(); n != 3 {
+		t.Errorf("expected the first attempt and 2 retries, got %d requests", n)
+	}
+	if stats := sender.Stats(); stats.Dropped != 1 || stats.Buffered != 0 {
+		t.Errorf("expected the event dropped once its retries were spent, got %+v", stats)
+	}
+}
+
+func TestMultiStatusRetryLimits(t *testing.T) {
+	var mu sync.Mutex
+	sends := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		var results []string
+		mu.Lock()
+		for _, e := range data.Events {
+			sends[e.Message]++
+			results = append(results, fmt.Sprintf(`{"status":%s}`, e.Message))
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `{"results":[%s]}`, strings.Join(results, ","))
+	}))
+	defer server.Close()
+
+	// Each message is the per-event status the server answers with.
+	sender := NewSender(server.URL, "test-key")
+	for _, status := range []string{"400", "500", "200"} {
+		sender.Log(status, nil)
+	}
+	for range 20 {
+		sender.Flush()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]int{"400": 1, "500": 1 + defaultBatchRetries, "200": 1}
+	if !reflect.DeepEqual(sends, want) {
+		t.Errorf("expected sends per status %v, got %v", want, sends)
+	}
+	if stats := sender.Stats(); stats.Dropped != 2 || stats.Sent != 1 || stats.Buffered != 0 {
+		t.Errorf("expected the rejects dropped once their retries are spent, got %+v", stats)
+	}
+}
+
+func TestMultiStatusMalformed(t *testing.T) {
+	for _, tt := range []struct{ name, body string }{
+		{"truncated", `{"results":[{"status":200},{"sta`},
+		{"short", `{"results":[{"status":200}]}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusMultiStatus)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			var errs []error
+			var delivered []string
+			sender := NewSender(server.URL, "test-key",
+				OnError(func(err error) { errs = append(errs, err) }),
+				OnDelivered(func(ids []string) { delivered = append(delivered, ids...) }))
+			sender.Log("first", nil)
+			sender.Log("second", nil)
+			if err := sender.FlushContext(context.Background()); !errors.Is(err, ErrServer) {
+				t.Errorf("expected a server error, got %v", err)
+			}
+			if len(delivered) != 0 {
+				t.Errorf("expected no events reported delivered, got %v", delivered)
+			}
+			if len(errs) != 1 {
+				t.Errorf("expected the failure reported once, got %v", errs)
+			}
+			if stats := sender.Stats(); stats.Sent != 0 || stats.Buffered != 2 {
+				t.Errorf("expected both events requeued for a retry, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestShouldRetryTransportLimits(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close() // every request fails to connect
+
+	var asked atomic.Int32
+	sender := NewSender(server.URL, "test-key", ShouldRetry(func(resp *http.Response, err error) bool {
+		asked.Add(1)
+		return resp == nil && err != nil
+	}))
+	sender.Log("unreachable", nil)
+	for range 10 {
+		sender.Flush()
+	}
+	if n := asked.Load(); n != 1+defaultBatchRetries {
+		t.Errorf("expected the predicate asked once per attempt, got %d", n)
+	}
+	if stats := sender.Stats(); stats.Buffered != 0 || stats.Dropped != 1 {
+		t.Errorf("expected the event dropped once BatchRetries are spent, got %+v", stats)
+	}
+}
+
+func TestFallbackHandler(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, endpoint := range []string{closed.URL, ""} {
+		var out bytes.Buffer
+		fallback := slog.NewTextHandler(&out, &slog.HandlerOptions{
+			ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		})
+		sender := NewSender(endpoint, "test-key", FallbackHandler(fallback))
+		slog.New(sender.NewHandler()).Warn("disk almost full", "free_mb", 120)
+		sender.Flush()
+
+		if got := out.String(); got != "level=WARN msg=\"disk almost full\" free_mb=120\n" {
+			t.Errorf("endpoint %q: expected the undelivered event on the fallback, got %q", endpoint, got)
+		}
+	}
+}
+
+func TestMiddlewareSkipsHealthChecks(t *testing.T) {
+	sender := NewSender("", "test-key", SkipPaths("/healthz"))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	probe := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" {
+			r = r.WithContext(ContextWithNoLog(r.Context()))
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	for _, path := range []string{"/healthz", "/readyz", "/users"} {
+		probe.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	events := sender.Snapshot()
+	if len(events) != 1 || events[0].Context["path"] != "/users" {
+		t.Fatalf("expected only the /users request to be logged, got %+v", events)
+	}
+}
+
+func TestMarshaler(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	var calls int
+	sender := NewSender(server.URL, "test-key", Marshaler(func(v any) ([]byte, error) {
+		calls++
+		return []byte(`{"custom":true}`), nil
+	}))
+	sender.Log("hello", nil)
+	if err := sender.FlushContext(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("expected marshaler to be called once, got %d", calls)
+	}
+	if string(body) != `{"custom":true}` {
+		t.Errorf("expected marshaler output verbatim, got %s", body)
+	}
+}
+
+func TestProtobufEncoding(t *testing.T) {
+	var body []byte
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer server.Close()
+
+	var sent []Event
+	sender := NewSender(server.URL, "test-key", WithEncoding(Protobuf), BeforeSend(func(e Event) (Event, bool) {
+		sent = append(sent, e)
+		return e, true
+	}))
+	slog.New(sender.NewHandler()).Info("order placed",
+		"order_id", 42, "total", 19.5, "paid", true, "coupon", nil,
+		"tags", []string{"gift", "rush"}, slog.Group("http", "status", 201))
+	sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil))
+	if err := sender.FlushContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/x-protobuf" {
+		t.Errorf("expected protobuf content type, got %q", contentType)
+	}
+	got, err := decodeProtoBatch(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Context values decode as their JSON types, so compare against the
+	// JSON round trip of what was sent.
+	raw, _ := json.Marshal(sent)
+	var want []Event
+	json.Unmarshal(raw, &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected protobuf round trip to match\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestCloudEventsEncoding(t *testing.T) {
+	// checkRequired validates the attributes CloudEvents 1.0 requires, plus
+	// the optional time, which must be RFC 3339.
+	checkRequired := func(t *testing.T, attrs map[string]string) {
+		t.Helper()
+		if attrs["specversion"] != "1.0" {
+			t.Errorf("expected specversion 1.0, got %q", attrs["specversion"])
+		}
+		for _, name := range []string{"id", "source", "type"} {
+			if attrs[name] == "" {
+				t.Errorf("expected required attribute %s, got %v", name, attrs)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339, attrs["time"]); err != nil {
+			t.Errorf("expected an RFC 3339 time, got %q", attrs["time"])
+		}
+	}
+
+	t.Run("structured", func(t *testing.T) {
+		var body []byte
+		var contentType string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			contentType = r.Header.Get("Content-Type")
+		}))
+		defer server.Close()
+
+		sender := NewSender(server.URL, "test-key", WithEncoding(CloudEvents), CloudEventsSource("/checkout"))
+		sender.Log("order placed", map[string]any{"order_id": 42})
+		sender.Log("order shipped", nil)
+		sender.Flush()
+
+		if contentType != "application/cloudevents-batch+json" {
+			t.Errorf("expected the CloudEvents batch content type, got %q", contentType)
+		}
+		var batch []map[string]any
+		if err := json.Unmarshal(body, &batch); err != nil || len(batch) != 2 {
+			t.Fatalf("expected a JSON array of 2 envelopes, got %s", body)
+		}
+		ids := map[string]bool{}
+		for i, ce := range batch {
+			attrs := map[string]string{}
+			for name, v := range ce {
+				if s, ok := v.(string); ok {
+					attrs[name] = s
+				}
+			}
+			checkRequired(t, attrs)
+			ids[attrs["id"]] = true
+			if attrs["source"] != "/checkout" || attrs["datacontenttype"] != "application/json" {
+				t.Errorf("expected the configured source and JSON data, got %v", attrs)
+			}
+			data, _ := ce["data"].(map[string]any)
+			if want := []string{"order placed", "order shipped"}[i]; data["message"] != want || data["id"] != attrs["id"] {
+				t.Errorf("expected the event in data, got %v", ce["data"])
+			}
+		}
+		if len(ids) != 2 {
+			t.Errorf("expected distinct event IDs, got %v", ids)
+		}
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		var mu sync.Mutex
+		var headers []http.Header
+		var bodies []map[string]any
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var e map[string]any
+			json.NewDecoder(r.Body).Decode(&e)
+			mu.Lock()
+			headers = append(headers, r.Header.Clone())
+			bodies = append(bodies, e)
+			mu.Unlock()
+		}))
+		defer server.Close()
+
+		sender := NewSender(server.URL, "test-key", WithEncoding(CloudEventsBinary))
+		sender.Log("order placed", nil)
+		sender.Log("order shipped", nil)
+		sender.Flush()
+
+		if len(headers) != 2 {
+			t.Fatalf("expected one request per event, got %d", len(headers))
+		}
+		for i, h := range headers {
+			attrs := map[string]string{}
+			for _, name := range []string{"specversion", "id", "source", "type", "time"} {
+				attrs[name] = h.Get("ce-" + name)
+			}
+			checkRequired(t, attrs)
+			if h.Get("Content-Type") != "application/json" || bodies[i]["id"] != attrs["id"] {
+				t.Errorf("expected the JSON event as the body, got %v %v", h.Get("Content-Type"), bodies[i])
+			}
+		}
+	})
+
+	// Consumers dedupe on source and id, so a resent event must keep its id.
+	for name, enc := range map[string]Encoding{"structured retry": CloudEvents, "binary retry": CloudEventsBinary} {
+		t.Run(name, func(t *testing.T) {
+			var ids []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				id := r.Header.Get("ce-id")
+				if enc == CloudEvents {
+					var batch []map[string]any
+					json.NewDecoder(r.Body).Decode(&batch)
+					id, _ = batch[0]["id"].(string)
+				}
+				ids = append(ids, id)
+				if len(ids) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer server.Close()
+
+			sender := NewSender(server.URL, "test-key", WithEncoding(enc))
+			sender.Log("order placed", nil)
+			sender.Flush()
+			sender.Flush()
+			if len(ids) != 2 || ids[0] == "" || ids[0] != ids[1] {
+				t.Errorf("expected the retry to keep the first attempt's id, got %q", ids)
+			}
+		})
+	}
+}
+
+// decodeProtoBatch is a minimal decoder for the lognorth.v1.Batch messages
+// that protoBatch writes.
+func decodeProtoBatch(b []byte) ([]Event, error) {
+	var events []Event
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		if field != 1 {
+			return nil
+		}
+		var e Event
+		err := protoFields(data, func(field int, v uint64, data []byte) error {
+			switch field {
+			case 1:
+				e.ID = string(data)
+			case 2:
+				e.Level = string(data)
+			case 3:
+				e.Message = string(data)
+			case 4:
+				e.Timestamp = string(data)
+			case 5:
+				e.DurationMS = int(v)
+			case 6:
+				e.TraceID = string(data)
+			case 7:
+				e.SpanID = string(data)
+			case 8:
+				e.Template = string(data)
+			case 9:
+				e.BatchID = string(data)
+			case 10:
+				m, err := decodeProtoStruct(data)
+				e.Context = m
+				return err
+			case 11:
+				e.CorrelationID = string(data)
+			}
+			return nil
+		})
+		events = append(events, e)
+		return err
+	})
+	return events, err
+}
+
+func decodeProtoStruct(b []byte) (map[string]any, error) {
+	m := make(map[string]any)
+	err := protoFields(b, func(_ int, _ uint64, entry []byte) error {
+		var key string
+		var value any
+		err := protoFields(entry, func(field int, _ uint64, data []byte) error {
+			if field == 1 {
+				key = string(data)
+				return nil
+			}
+			var err error
+			value, err = decodeProtoValue(data)
+			return err
+		})
+		m[key] = value
+		return err
+	})
+	return m, err
+}
+
+func decodeProtoValue(b []byte) (any, error) {
+	var out any
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		var err error
+		switch field {
+		case 1:
+			out = nil
+		case 2:
+			out = math.Float64frombits(v)
+		case 3:
+			out = string(data)
+		case 4:
+			out = v != 0
+		case 5:
+			out, err = decodeProtoStruct(data)
+		case 6:
+			list := []any{}
+			err = protoFields(data, func(_ int, _ uint64, item []byte) error {
+				iv, err := decodeProtoValue(item)
+				list = append(list, iv)
+				return err
+			})
+			out = list
+		}
+		return err
+	})
+	return out, err
+}
+
+// protoFields calls fn for each field in b with its number and either its
+// numeric value (varint and fixed64) or its bytes (length-delimited).
+func protoFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("bad field key")
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("bad varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("short fixed64")
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errors.New("bad length")
+			}
+			data, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return fmt.Errorf("unexpected wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	for _, tt := range []struct {
+		codecs []string
+		want   string
+	}{
+		{[]string{"zstd", "gzip"}, "gzip"}, // zstd is not linked into this test binary
+		{[]string{"zstd"}, ""},
+		{nil, ""},
+	} {
+		var body []byte
+		var encoding string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding = r.Header.Get("Content-Encoding")
+			body, _ = io.ReadAll(r.Body)
+		}))
+
+		sender := NewSender(server.URL, "test-key", Compress(tt.codecs...))
+		sender.Log("hello", map[string]any{"n": 1})
+		sender.Flush()
+		server.Close()
+
+		if encoding != tt.want {
+			t.Errorf("%v: expected Content-Encoding %q, got %q", tt.codecs, tt.want, encoding)
+		}
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = io.ReadAll(zr)
+		}
+		var data struct{ Events []Event }
+		if err := json.Unmarshal(body, &data); err != nil || len(data.Events) != 1 || data.Events[0].Message != "hello" {
+			t.Errorf("%v: expected the batch after decompression, got %q", tt.codecs, body)
+		}
+	}
+}
+
+func TestSoftBufferSize(t *testing.T) {
+	received := make(chan int, 10)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		received <- len(data.Events)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sender := NewSender(server.URL, "test-key", BatchSize(100), SoftBufferSize(3), MaxBufferSize(5))
+	for i := range 3 {
+		sender.Log(fmt.Sprintf("event %d", i), nil)
+	}
+	select {
+	case n := <-received:
+		if n != 3 {
+			t.Errorf("expected soft-cap flush of 3 events, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected crossing the soft cap to trigger a flush")
+	}
+
+	// While that flush is in flight the buffer refills up to the hard cap.
+	for i := range 6 {
+		sender.Log(fmt.Sprintf("late %d", i), nil)
+	}
+	stats := sender.Stats()
+	if stats.Buffered != 5 || stats.Dropped != 1 {
+		t.Errorf("expected hard cap to hold 5 and drop 1, got %+v", stats)
+	}
+}
+
+func TestGlobalMaxConcurrency(t *testing.T) {
+	for _, limit := range []int{1, 2} {
+		t.Run(strconv.Itoa(limit), func(t *testing.T) {
+			var active, peak, received atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := active.Add(1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+				time.Sleep(10 * time.Millisecond)
+				var data struct{ Events []Event }
+				json.NewDecoder(r.Body).Decode(&data)
+				received.Add(int32(len(data.Events)))
+				active.Add(-1)
+			}))
+			defer server.Close()
+
+			sender := NewSender(server.URL, "test-key", GlobalMaxConcurrency(limit))
+			billing := slog.New(sender.NewHandler()).With("module", "billing")
+			auth := slog.New(sender.NewHandler()).With("module", "auth")
+			var wg sync.WaitGroup
+			for i := range 8 {
+				logger := billing
+				if i%2 == 1 {
+					logger = auth
+				}
+				wg.Go(func() {
+					logger.Error("failed", "error", errors.New("boom"))
+					logger.Info("done")
+					sender.Flush()
+				})
+			}
+			wg.Wait()
+			sender.Flush()
+			sender.Wait()
+
+			if got := peak.Load(); got > int32(limit) {
+				t.Errorf("expected at most %d concurrent requests, saw %d", limit, got)
+			}
+			if got := received.Load(); got != 16 {
+				t.Errorf("expected all 16 events delivered, got %d", got)
+			}
+		})
+	}
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	var mu sync.Mutex
+	var beats int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range data.Events {
+			if e.Message == "heartbeat" {
+				beats++
+			}
+		}
+	}))
+	defer server.Close()
+
+	ticks := make(chan time.Time)
+	sender := NewSender(server.URL, "test-key")
+	sender.mu.Lock()
+	sender.beatTick = ticks
+	sender.opts.heartbeat = time.Minute
+	sender.startHeartbeat()
+	sender.mu.Unlock()
+
+	for range 3 {
+		ticks <- time.Time{}
+	}
+	if err := sender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if beats != 3 {
+		t.Errorf("expected a heartbeat per tick, got %d", beats)
+	}
+	mu.Unlock()
+
+	select {
+	case ticks <- time.Time{}:
+		t.Error("expected the heartbeat goroutine to exit on Close")
+	default:
+	}
+}
+
+func TestFlushCoalescing(t *testing.T) {
+	var active, peak, received atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		<-release
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		received.Add(int32(len(data.Events)))
+		active.Add(-1)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", BatchSize(2))
+	for i := range 20 {
+		sender.Log(fmt.Sprintf("event %d", i), nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	sender.Wait()
+
+	if got := peak.Load(); got != 1 {
+		t.Errorf("expected at most one flush in flight, saw %d concurrent requests", got)
+	}
+	if got := received.Load(); got != 20 {
+		t.Errorf("expected all 20 events delivered, got %d", got)
+	}
+}
+
+func TestWait(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		received.Add(int32(len(data.Events)))
+	}))
+	defer server.Close()
+
+	h := NewSender(server.URL, "test-key", BatchSize(2)).NewHandler()
+	logger := slog.New(h)
+	logger.Error("first", "error", fmt.Errorf("boom"))
+	logger.Error("second", "error", fmt.Errorf("boom"))
+	logger.Info("a")
+	logger.Info("b")
+	h.Wait()
+
+	if got := received.Load(); got != 4 {
+		t.Errorf("expected Wait to return after all 4 events arrived, got %d", got)
+	}
+}
+
+func TestErrorAttrsStringified(t *testing.T) {
+	h := NewSender("", "test-key").NewHandler()
+	slog.New(h).Info("retrying",
+		"cause", fmt.Errorf("dial tcp: timeout"),
+		slog.Group("db", "err", &queryError{table: "users"}, "attempt", 2),
+	)
+
+	e := h.Snapshot()[0]
+	if e.Context["cause"] != "dial tcp: timeout" {
+		t.Errorf("expected error under custom key stringified, got %#v", e.Context["cause"])
+	}
+	db, ok := e.Context["db"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected group as nested object, got %#v", e.Context["db"])
+	}
+	if db["err"] != (&queryError{table: "users"}).Error() || db["attempt"] != int64(2) {
+		t.Errorf("expected error inside group stringified, got %#v", db)
+	}
+}
+
+func TestLevelMapper(t *testing.T) {
+	h := NewSender("", "test-key", BufferErrors(true), LevelMapper(func(l slog.Level) string {
+		if l == slog.LevelWarn {
+			return "warning"
+		}
+		return strconv.Itoa(int(l))
+	})).NewHandler()
+	logger := slog.New(h)
+	logger.Warn("disk almost full")
+	logger.Info("started")
+	logger.Error("failed", "error", fmt.Errorf("boom"))
+
+	var got []string
+	for _, e := range h.Snapshot() {
+		got = append(got, e.Level)
+	}
+	if want := []string{"warning", "0", "8"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected levels %v, got %v", want, got)
+	}
+}
+
+func TestFlushBytes(t *testing.T) {
+	received := make(chan int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		received <- len(data.Events)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", BatchSize(100), FlushBytes(2500))
+	payload := strings.Repeat("x", 1000)
+	for i := range 3 {
+		sender.Log(fmt.Sprintf("large %d", i), map[string]any{"payload": payload})
+	}
+	select {
+	case n := <-received:
+		if n != 3 {
+			t.Errorf("expected byte trigger to flush 3 events, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected buffered bytes to trigger a flush before BatchSize")
+	}
+	sender.Wait()
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if sender.bytes != 0 {
+		t.Errorf("expected buffered byte count to reset after flush, got %d", sender.bytes)
+	}
+}
+
+func TestOnResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"ingest_id":"ing_123"}`))
+	}))
+	defer server.Close()
+
+	var status int
+	var body string
+	sender := NewSender(server.URL, "test-key", OnResponse(func(s int, b []byte) {
+		status, body = s, string(b)
+	}))
+	sender.Log("hello", nil)
+	sender.Flush()
+
+	if status != http.StatusAccepted || body != `{"ingest_id":"ing_123"}` {
+		t.Errorf("expected hook to see 202 and ingest body, got %d %q", status, body)
+	}
+}
+
+func TestNewTestHandler(t *testing.T) {
+	h, rec := NewTestHandler()
+	logger := slog.New(h)
+	logger.Info("User signed up", "user_id", 123)
+	logger.Error("Checkout failed", "error", fmt.Errorf("card declined"))
+
+	events := rec.Events()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 recorded events, got %d", len(events))
+	}
+	if events[0].Message != "User signed up" || events[0].Context["user_id"] != int64(123) {
+		t.Errorf("unexpected first event %+v", events[0])
+	}
+	if events[1].Message != "Checkout failed" || events[1].Context["error"] != "card declined" {
+		t.Errorf("unexpected second event %+v", events[1])
+	}
+
+	rec.Reset()
+	if got := rec.Events(); len(got) != 0 {
+		t.Errorf("expected no events after Reset, got %d", len(got))
+	}
+}
+
+func TestTraceIDFromContextWithoutMiddleware(t *testing.T) {
+	h := NewSender("", "test-key").NewHandler()
+	ctx := ContextWithTraceID(context.Background(), "job-trace-1")
+	slog.New(h).InfoContext(ctx, "job started")
+
+	if e := h.Snapshot()[0]; e.TraceID != "job-trace-1" {
+		t.Errorf("expected trace_id promoted from context, got %q", e.TraceID)
+	}
+}
+
+func TestSplitOn413(t *testing.T) {
+	var mu sync.Mutex
+	var accepted []int
+	var rejected int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		mu.Lock()
+		defer mu.Unlock()
+		if len(data.Events) > 2 {
+			rejected++
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		accepted = append(accepted, len(data.Events))
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", BatchSize(100))
+	for i := range 7 {
+		sender.Log(fmt.Sprintf("event %d", i), nil)
+	}
+	if err := sender.FlushContext(context.Background()); err != nil {
+		t.Fatalf("expected split batches to be accepted, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 7 → 3+4 → (1+2)+(2+2)
+	if rejected != 3 || fmt.Sprint(accepted) != "[1 2 2 2]" {
+		t.Errorf("expected 3 rejections then batches [1 2 2 2], got %d and %v", rejected, accepted)
+	}
+	if stats := sender.Stats(); stats.Sent != 7 || stats.Dropped != 0 {
+		t.Errorf("expected all 7 events sent, got %+v", stats)
+	}
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	sender := NewSender("", "test-key", LatencyBuckets(time.Second, 100*time.Millisecond, 250*time.Millisecond))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/report", nil))
+
+	if got := sender.Snapshot()[0].Context["latency_bucket"]; got != "100ms-250ms" {
+		t.Errorf("expected 150ms request in 100ms-250ms bucket, got %v", got)
+	}
+
+	bounds := []time.Duration{100 * time.Millisecond, 250 * time.Millisecond, time.Second}
+	for d, want := range map[time.Duration]string{
+		50 * time.Millisecond:  "<100ms",
+		250 * time.Millisecond: "250ms-1s",
+		2 * time.Second:        ">=1s",
+	} {
+		if got := latencyBucket(bounds, d); got != want {
+			t.Errorf("latencyBucket(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestEventSink(t *testing.T) {
+	ch := make(chan Event, 1)
+	sender := NewSender("", "test-key", EventSink(ch))
+	logger := slog.New(sender.NewHandler())
+	logger.Info("first", "n", 1)
+	logger.Info("second") // channel full: skipped, not blocking
+
+	select {
+	case e := <-ch:
+		if e.Message != "first" || e.Context["n"] != int64(1) {
+			t.Errorf("unexpected event on sink %+v", e)
+		}
+	default:
+		t.Fatal("expected logged event on the sink channel")
+	}
+	if len(ch) != 0 {
+		t.Errorf("expected second event to be dropped from the full sink")
+	}
+	if got := len(sender.Snapshot()); got != 2 {
+		t.Errorf("expected both events still buffered for delivery, got %d", got)
+	}
+}
+
+func TestEventSinkIDs(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		mu.Lock()
+		for _, e := range data.Events {
+			sent = append(sent, e.ID)
+		}
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	ch := make(chan Event, 2)
+	sender := NewSender(server.URL, "test-key", EventSink(ch))
+	sender.Log("batched", nil)
+	sender.Error("immediate", errors.New("boom"), nil)
+	sender.Flush()
+	sender.Wait()
+
+	close(ch)
+	var sunk []string
+	for e := range ch {
+		sunk = append(sunk, e.ID)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(sent)
+	slices.Sort(sunk)
+	if len(sunk) != 2 || sunk[0] == "" || !slices.Equal(sunk, sent) {
+		t.Errorf("expected the sink to see the sent IDs %v, got %v", sent, sunk)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(`{"results":[{"status":503}]}`))
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sender := NewSender(server.URL, "test-key", RetryBudgetPerSecond(2), BatchRetries(100))
+	sender.now = func() time.Time { return now }
+
+	sender.Log("rejected forever", nil)
+	var skipped int
+	for range 10 {
+		if errors.Is(sender.FlushContext(context.Background()), ErrRetryBudget) {
+			skipped++
+		}
+	}
+	// One first attempt, then only the 2 retries the budget allows.
+	if got := attempts.Load(); got != 3 || skipped != 7 {
+		t.Errorf("expected 3 attempts and 7 skipped retries, got %d and %d", got, skipped)
+	}
+	if got := sender.Stats().Buffered; got != 1 {
+		t.Errorf("expected the event to stay buffered while over budget, got %d", got)
+	}
+
+	now = now.Add(time.Second)
+	for range 10 {
+		sender.FlushContext(context.Background())
+	}
+	if got := attempts.Load(); got != 5 {
+		t.Errorf("expected the refilled budget to allow 2 more attempts, got %d total", got)
+	}
+}
+
+func TestRetryBudgetHoldsEvents(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", RetryBudgetPerSecond(0.2), BatchRetries(5), RetryDelay(time.Millisecond))
+	sender.interval = time.Millisecond
+	sender.Log("rejected", nil)
+	sender.Flush()
+	// The timer resends once on the single token, then finds the budget empty.
+	time.Sleep(200 * time.Millisecond)
+
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("expected the first attempt and one budgeted retry, got %d", got)
+	}
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if len(sender.buffer) != 1 || sender.buffer[0].tries != 2 {
+		t.Fatalf("expected the event held with the 2 attempts it made, got %+v", sender.buffer)
+	}
+	// The next token is due 5s after the retry spent the last one.
+	if wait := time.Until(sender.deadline); wait < 4*time.Second {
+		t.Errorf("expected the timer armed for the next token, fires in %v", wait)
+	}
+}
+
+func doThing(logger *slog.Logger) {
+	logger.Error("thing failed", "error", fmt.Errorf("boom"))
+}
+
+func TestErrorFunction(t *testing.T) {
+	h := NewSender("", "test-key", BufferErrors(true)).NewHandler()
+	doThing(slog.New(h))
+
+	fn, _ := h.Snapshot()[0].Context["error_function"].(string)
+	if !strings.HasSuffix(fn, ".doThing") {
+		t.Errorf("expected error_function naming doThing, got %q", fn)
+	}
+}
+
+func TestMiddlewareCaptureQueryParams(t *testing.T) {
+	sender := NewSender("", "test-key", CaptureQueryParams("page", "sort", "missing"))
+	handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users?page=2&sort=name&token=secret", nil))
+
+	query, ok := sender.Snapshot()[0].Context["query"].(map[string]any)
+	if !ok {
+		t.Fatal("expected query object in context")
+	}
+	if len(query) != 2 || query["page"] != "2" || query["sort"] != "name" {
+		t.Errorf("expected only allowlisted params, got %v", query)
+	}
+}
+
+func TestBlockOnFull(t *testing.T) {
+	received := make(chan int, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		received <- len(data.Events)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", BatchSize(100), MaxBufferSize(2), BlockOnFull(time.Second))
+	sender.Log("one", nil)
+	sender.Log("two", nil)
+
+	done := make(chan struct{})
+	go func() {
+		sender.Log("three", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected producer to block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sender.Flush()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected producer to proceed after the flush")
+	}
+	if n := <-received; n != 2 {
+		t.Errorf("expected flush of 2 events, got %d", n)
+	}
+	if stats := sender.Stats(); stats.Dropped != 0 || stats.Buffered != 1 {
+		t.Errorf("expected no drops and the third event buffered, got %+v", stats)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	newServer := func(cfg *tls.Config, version *atomic.Uint32) *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			version.Store(uint32(r.TLS.Version))
+		}))
+		server.TLS = cfg
+		server.Config.ErrorLog = log.New(io.Discard, "", 0) // silence handshake errors
+		server.StartTLS()
+		return server
+	}
+	trust := func(server *httptest.Server) Option {
+		pool := x509.NewCertPool()
+		pool.AddCert(server.Certificate())
+		return TLSConfig(&tls.Config{RootCAs: pool})
+	}
+
+	t.Run("negotiates TLS 1.3", func(t *testing.T) {
+		var version atomic.Uint32
+		server := newServer(&tls.Config{MinVersion: tls.VersionTLS13}, &version)
+		defer server.Close()
+
+		sender := NewSender(server.URL, "test-key", trust(server), TLSMinVersion(tls.VersionTLS12))
+		sender.Log("hello", nil)
+		if err := sender.FlushContext(context.Background()); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		if version.Load() != tls.VersionTLS13 {
+			t.Errorf("expected TLS 1.3, got %x", version.Load())
+		}
+	})
+
+	t.Run("rejects lower version", func(t *testing.T) {
+		var version atomic.Uint32
+		server := newServer(&tls.Config{MaxVersion: tls.VersionTLS12}, &version)
+		defer server.Close()
+
+		sender := NewSender(server.URL, "test-key", trust(server), TLSMinVersion(tls.VersionTLS13))
+		sender.Log("hello", nil)
+		if err := sender.FlushContext(context.Background()); !errors.Is(err, ErrTransport) {
+			t.Errorf("expected handshake failure, got %v", err)
+		}
+		if version.Load() != 0 {
+			t.Errorf("expected no request to reach the server")
+		}
+	})
+}
+
+func TestHandlerConfig(t *testing.T) {
+	h := NewSender("https://logs.example.com", "sk_live_abcd1234", MaxBufferSize(500)).NewHandler()
+	c := h.Config()
+
+	if c.BatchSize != defaultBatchSize || c.FlushInterval != defaultFlushInterval {
+		t.Errorf("expected defaulted batch size and interval, got %d and %v", c.BatchSize, c.FlushInterval)
+	}
+	if c.MaxBufferSize != 500 || c.Endpoint != "https://logs.example.com" || c.SampleRate != 1 {
+		t.Errorf("expected configured values, got %+v", c)
+	}
+	if c.APIKey != "************1234" || strings.Contains(fmt.Sprint(c), "abcd") {
+		t.Errorf("expected masked API key, got %q", c.APIKey)
+	}
+}
+
+func TestSigningSecret(t *testing.T) {
+	secret := []byte("gateway-secret")
+	var body []byte
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get("X-Signature")
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", SigningSecret(secret))
+	sender.Log("signed", nil)
+	sender.Flush()
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	if want := hex.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("expected X-Signature %q, got %q", want, signature)
+	}
+
+	// Ping is signed too, so it passes a gateway that checks the HMAC.
+	if err := sender.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mac = hmac.New(sha256.New, secret)
+	mac.Write(body)
+	if want := hex.EncodeToString(mac.Sum(nil)); string(body) != `{"events":[]}` || signature != want {
+		t.Errorf("expected Ping signed with X-Signature %q, got %q for %s", want, signature, body)
+	}
+}
+
+func TestFlushAtAlignsToWallClock(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 37, 0, time.UTC)
+	sender := NewSender("", "test-key", FlushAt(time.Minute))
+	sender.now = func() time.Time { return now }
+	deadline := func() time.Time {
+		sender.mu.Lock()
+		defer sender.mu.Unlock()
+		return sender.deadline
+	}
+
+	sender.Log("first", nil)
+	if want := time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC); !deadline().Equal(want) {
+		t.Errorf("expected flush on the minute at %v, got %v", want, deadline())
+	}
+
+	now = time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC)
+	sender.Flush()
+	sender.Log("second", nil)
+	if want := time.Date(2024, 3, 1, 12, 2, 0, 0, time.UTC); !deadline().Equal(want) {
+		t.Errorf("expected next flush at the following boundary %v, got %v", want, deadline())
+	}
+}
+
+func TestSetAPIKey(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	h := NewSender(server.URL, "old-key").NewHandler()
+	slog.New(h).Info("queued before rotation")
+	h.SetAPIKey("new-key")
+	h.sender.Flush()
+
+	if auth != "Bearer new-key" {
+		t.Errorf("expected buffered event sent with the new key, got %q", auth)
+	}
+	if got := h.Config().APIKey; got != "***-key" {
+		t.Errorf("expected Config to report the masked new key, got %q", got)
+	}
+}
+
+type transportFunc func(ctx context.Context, events []Event) error
+
+func (f transportFunc) Send(ctx context.Context, events []Event) error { return f(ctx, events) }
+
+func TestWithTransport(t *testing.T) {
+	var got []Event
+	fail := false
+	sender := NewSender("", "", WithTransport(transportFunc(func(_ context.Context, events []Event) error {
+		if fail {
+			return fmt.Errorf("queue unavailable")
+		}
+		got = append(got, events...)
+		return nil
+	})))
+
+	sender.Log("via transport", nil)
+	if err := sender.FlushContext(context.Background()); err != nil || len(got) != 1 || got[0].Message != "via transport" {
+		t.Fatalf("expected event delivered through the transport, got %v %v", got, err)
+	}
+
+	fail = true
+	sender.Log("lost", nil)
+	if err := sender.FlushContext(context.Background()); !errors.Is(err, ErrTransport) {
+		t.Errorf("expected transport failure classified as ErrTransport, got %v", err)
+	}
+	if stats := sender.Stats(); stats.Sent != 1 || stats.TransportErrors != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTransportPartialError(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		opts  []Option
+		log   func(s *Sender, msg string)
+		flush func(s *Sender)
+	}{
+		{"info", nil, func(s *Sender, msg string) { s.Log(msg, nil) }, (*Sender).Flush},
+		{"error", []Option{BufferErrors(true)}, func(s *Sender, msg string) { s.Error(msg, errors.New("boom"), nil) }, (*Sender).FlushErrors},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls [][]string
+			opts := append(tt.opts, WithTransport(transportFunc(func(_ context.Context, events []Event) error {
+				var messages []string
+				for _, e := range events {
+					messages = append(messages, e.Message)
+				}
+				calls = append(calls, messages)
+				if len(calls) == 1 {
+					return &PartialError{Failed: []int{1}, Err: errors.New("throttled")}
+				}
+				return nil
+			})))
+			sender := NewSender("", "", opts...)
+			for _, msg := range []string{"a", "b", "c"} {
+				tt.log(sender, msg)
+			}
+			tt.flush(sender)
+			sender.Flush()
+
+			if want := [][]string{{"a", "b", "c"}, {"b"}}; !reflect.DeepEqual(calls, want) {
+				t.Errorf("expected only the failed event resent, got %v", calls)
+			}
+			if stats := sender.Stats(); stats.Sent != 3 || stats.TransportErrors != 1 || stats.Buffered != 0 || stats.Dropped != 0 {
+				t.Errorf("expected every event sent exactly once, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestWithGroupNestsAttrs(t *testing.T) {
+	h := NewSender("", "test-key").NewHandler()
+	logger := slog.New(h).With("service", "api").WithGroup("db").With("table", "users")
+	logger.Info("query", "rows", 3)
+	logger.WithGroup("pool").Info("stats")
+
+	events := h.Snapshot()
+	if events[0].Context["service"] != "api" {
+		t.Errorf("expected attrs before WithGroup at top level, got %v", events[0].Context)
+	}
+	db, _ := events[0].Context["db"].(map[string]any)
+	if db["table"] != "users" || db["rows"] != int64(3) {
+		t.Errorf("expected handler and record attrs under context.db, got %v", events[0].Context)
+	}
+	db, _ = events[1].Context["db"].(map[string]any)
+	if _, ok := db["pool"]; ok || db["table"] != "users" {
+		t.Errorf("expected empty group omitted, got %v", events[1].Context)
+	}
+}
+
+func TestTemplateKey(t *testing.T) {
+	h := NewSender("", "test-key", TemplateKey("msg_template")).NewHandler()
+	slog.New(h).Info("User 42 signed up", "msg_template", "User {id} signed up", "id", 42)
+
+	e := h.Snapshot()[0]
+	if e.Template != "User {id} signed up" {
+		t.Errorf("expected template lifted to top level, got %q", e.Template)
+	}
+	if _, ok := e.Context["msg_template"]; ok || e.Context["id"] != int64(42) {
+		t.Errorf("expected template removed from context, got %v", e.Context)
+	}
+	body, _ := json.Marshal(e)
+	if !strings.Contains(string(body), `"template":"User {id} signed up"`) {
+		t.Errorf("expected template field in JSON, got %s", body)
+	}
+}
+
+func TestCorrelationKey(t *testing.T) {
+	h := NewSender("", "test-key").NewHandler()
+	slog.New(h).Info("charged", "correlation_id", "order-7", "amount", 12)
+	e := h.Snapshot()[0]
+	if e.CorrelationID != "order-7" {
+		t.Errorf("expected correlation_id lifted to top level, got %q", e.CorrelationID)
+	}
+	if _, ok := e.Context["correlation_id"]; ok || e.Context["amount"] != int64(12) {
+		t.Errorf("expected correlation_id removed from context, got %v", e.Context)
+	}
+	body, _ := json.Marshal(e)
+	if !strings.Contains(string(body), `"correlation_id":"order-7"`) {
+		t.Errorf("expected correlation_id field in JSON, got %s", body)
+	}
+
+	h = NewSender("", "test-key", CorrelationKey("cid")).NewHandler()
+	slog.New(h).Info("charged", "cid", 99)
+	if e := h.Snapshot()[0]; e.CorrelationID != "99" || e.Context != nil {
+		t.Errorf("expected custom key lifted and formatted, got %q %v", e.CorrelationID, e.Context)
+	}
+}
+
+func TestAPIKeyFile(t *testing.T) {
+	var mu sync.Mutex
+	var auth []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(path, []byte("file-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSender(server.URL, "", APIKeyFile(path))
+	sender.Log("from file", nil)
+	sender.Flush()
+
+	// A key func wins over the file and is asked again for every request.
+	keys := []string{"rotated-1", "rotated-2"}
+	sender = NewSender(server.URL, "", APIKeyFile(path), APIKeyFunc(func() (string, error) {
+		key := keys[0]
+		keys = keys[1:]
+		return key, nil
+	}))
+	sender.Log("first", nil)
+	sender.Flush()
+	sender.Log("second", nil)
+	sender.Flush()
+
+	want := []string{"Bearer file-key", "Bearer rotated-1", "Bearer rotated-2"}
+	if !slices.Equal(auth, want) {
+		t.Errorf("expected auth headers %q, got %q", want, auth)
+	}
+
+	var got []error
+	NewSender(server.URL, "fallback-key", APIKeyFile(filepath.Join(t.TempDir(), "missing")), OnError(func(err error) { got = append(got, err) }))
+	if len(got) != 1 || !errors.Is(got[0], os.ErrNotExist) {
+		t.Errorf("expected the unreadable file reported to OnError, got %v", got)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	if err := NewSender(server.URL, "good-key").NewHandler().Ping(context.Background()); err != nil {
+		t.Errorf("expected nil for a 2xx response, got %v", err)
+	}
+	h := NewSender(server.URL, "bad-key").NewHandler()
+	if err := h.Ping(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized for a 401 response, got %v", err)
+	}
+	if stats := h.Stats(); stats.Failed != 0 {
+		t.Errorf("expected Ping to leave counters alone, got %+v", stats)
+	}
+}
+
+func TestMaxAttrs(t *testing.T) {
+	h := NewSender("", "test-key", MaxAttrs(3)).NewHandler()
+	logger := slog.New(h).With("service", "api")
+	args := make([]any, 0, 20)
+	for i := range 10 {
+		args = append(args, fmt.Sprintf("k%d", i), i)
+	}
+	logger.Info("runaway", args...)
+	logger.Info("small", "k0", 0)
+
+	e := h.Snapshot()[0]
+	if len(e.Context) != 4 || e.Context["attrs_truncated"] != true {
+		t.Errorf("expected 3 attrs plus the truncation marker, got %v", e.Context)
+	}
+	if e.Context["service"] != "api" || e.Context["k1"] != int64(1) || e.Context["k2"] != nil {
+		t.Errorf("expected handler attrs first, then the earliest record attrs, got %v", e.Context)
+	}
+	if _, ok := h.Snapshot()[1].Context["attrs_truncated"]; ok {
+		t.Error("expected no marker under the limit")
+	}
+}
+
+func TestZeroTimeRecords(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sender := NewSender("", "test-key")
+	sender.now = func() time.Time { return now }
+	h := sender.NewHandler()
+	h.Handle(context.Background(), slog.NewRecord(time.Time{}, slog.LevelInfo, "zero", 0))
+	h.Handle(context.Background(), slog.NewRecord(now.Add(-time.Hour), slog.LevelInfo, "set", 0))
+
+	events := h.Snapshot()
+	if events[0].Timestamp != "2024-03-01T12:00:00Z" {
+		t.Errorf("expected a zero Time stamped from the clock, got %s", events[0].Timestamp)
+	}
+	if events[1].Timestamp != "2024-03-01T11:00:00Z" {
+		t.Errorf("expected the record's own Time, got %s", events[1].Timestamp)
+	}
+
+	h = NewSender("", "test-key", DefaultZeroTimeToNow(false)).NewHandler()
+	h.Handle(context.Background(), slog.NewRecord(time.Time{}, slog.LevelInfo, "zero", 0))
+	if ts := h.Snapshot()[0].Timestamp; ts != "0001-01-01T00:00:00Z" {
+		t.Errorf("expected the zero time kept when disabled, got %s", ts)
+	}
+}
+
+func TestMaxStringLen(t *testing.T) {
+	h := NewSender("", "test-key", MaxStringLen(100)).NewHandler()
+	body := strings.Repeat("a", 1<<20)
+	slog.New(h).Info("request", "body", body, "short", "ok")
+
+	e := h.Snapshot()[0]
+	want := strings.Repeat("a", 100) + fmt.Sprintf("…[truncated %d bytes]", 1<<20-100)
+	if e.Context["body"] != want {
+		t.Errorf("expected body cut to 100 bytes plus suffix, got %d bytes", len(e.Context["body"].(string)))
+	}
+	if e.Context["short"] != "ok" {
+		t.Errorf("expected short strings untouched, got %v", e.Context["short"])
+	}
+
+	// Error strings are cut at every layer of the chain.
+	h = NewSender("", "test-key", MaxStringLen(10), BufferErrors(true)).NewHandler()
+	cause := errors.New(strings.Repeat("b", 100))
+	slog.New(h).Error("charge failed", "error", fmt.Errorf("charging: %w", cause))
+	e = h.Snapshot()[0]
+	if want := "charging: …[truncated 100 bytes]"; e.Context["error"] != want {
+		t.Errorf("expected the error string cut, got %q", e.Context["error"])
+	}
+	for _, layer := range e.Context["error_chain"].([]map[string]any) {
+		if msg := layer["message"].(string); !strings.Contains(msg, "…[truncated") {
+			t.Errorf("expected every error_chain message cut, got %q", msg)
+		}
+	}
+
+	// Cuts never split a multi-byte rune.
+	if got := truncateString("héllo", 2); got != "h…[truncated 5 bytes]" {
+		t.Errorf("expected cut on a rune boundary, got %q", got)
+	}
+}
+
+func TestStringifyContext(t *testing.T) {
+	h := NewSender("", "test-key", StringifyContext(true)).NewHandler()
+	slog.New(h).Info("order placed",
+		"count", 3,
+		"total", 19.5,
+		"paid", true,
+		"at", time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600)),
+		slog.Group("http", "status", 201),
+	)
+
+	want := map[string]any{
+		"count":       "3",
+		"total":       "19.5",
+		"paid":        "true",
+		"at":          "2024-03-01T11:00:00Z",
+		"http.status": "201",
+	}
+	if got := h.Snapshot()[0].Context; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected string context %v, got %v", want, got)
+	}
+
+	h = NewSender("", "test-key").NewHandler()
+	slog.New(h).Info("order placed", "count", 3)
+	if got := h.Snapshot()[0].Context["count"]; got != int64(3) {
+		t.Errorf("expected typed values by default, got %T %v", got, got)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	var out bytes.Buffer
+	sender := NewSender("", "", WriterSink(&out), BatchSize(2))
+	sender.Log("first", map[string]any{"n": 1})
+	sender.Log("second", nil)
+	sender.Wait()
+	sender.Log("third", nil)
+	sender.Flush()
+
+	var got []string
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for _, line := range lines {
+		var batch struct{ Events []Event }
+		if err := json.Unmarshal([]byte(line), &batch); err != nil {
+			t.Fatalf("expected one JSON batch per line, got %q: %v", line, err)
+		}
+		for _, e := range batch.Events {
+			got = append(got, e.Message)
+		}
+	}
+	if len(lines) != 2 || fmt.Sprint(got) != "[first second third]" {
+		t.Errorf("expected 2 batches holding the 3 events, got %d lines %v", len(lines), got)
+	}
+	if stats := sender.Stats(); stats.Sent != 3 {
+		t.Errorf("expected written events counted as sent, got %+v", stats)
+	}
+}
+
+func TestMiddlewareClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trust   bool
+		headers map[string]string
+		want    string
+	}{
+		{"direct", false, nil, "192.0.2.1"},
+		{"forged header ignored", false, map[string]string{"X-Forwarded-For": "203.0.113.9"}, "192.0.2.1"},
+		{"forwarded", true, map[string]string{"X-Forwarded-For": "203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{"real ip", true, map[string]string{"X-Real-IP": "2001:db8::1"}, "2001:db8::1"},
+		{"invalid header", true, map[string]string{"X-Forwarded-For": "unknown"}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := NewSender("", "test-key", TrustProxyHeaders(tt.trust))
+			handler := sender.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest("GET", "/", nil) // RemoteAddr 192.0.2.1:1234
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := sender.Snapshot()[0].Context["client_ip"]; got != tt.want {
+				t.Errorf("expected client_ip %q, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReplaySpool(t *testing.T) {
+	var mu sync.Mutex
+	var down atomic.Bool
+	var requests, rejectAt atomic.Int32
+	var messages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() || requests.Add(1) == rejectAt.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		mu.Lock()
+		for _, e := range data.Events {
+			messages = append(messages, e.Message)
+		}
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	sender := NewSender(server.URL, "test-key", SpoolDir(dir))
+	down.Store(true)
+	for i := range 30 {
+		sender.Log(fmt.Sprintf("event %d", i), nil)
+	}
+	sender.Wait()
+	// Each failed flush spools one batch and stops, keeping the rest queued.
+	for sender.Stats().Buffered > 0 {
+		sender.Flush()
+	}
+	if stats := sender.Stats(); stats.Spooled != 30 || stats.Dropped != 0 {
+		t.Fatalf("expected 30 spooled events during the outage, got %+v", stats)
+	}
+	down.Store(false)
+
+	// The second batch fails; the next Replay resumes from there.
+	rejectAt.Store(2)
+	if err := sender.Replay(context.Background(), 100); !errors.Is(err, ErrServer) {
+		t.Fatalf("expected interrupted replay, got %v", err)
+	}
+
+	start := time.Now()
+	if err := sender.Replay(context.Background(), 100); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	// 20 remaining events at 100/s go out in batches of 10, 100ms apart.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected replay paced at the rate, took %v", elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	seen := make(map[string]bool)
+	for _, m := range messages {
+		seen[m] = true
+	}
+	if len(messages) != 30 || len(seen) != 30 {
+		t.Errorf("expected each of the 30 events replayed exactly once, got %d (%d unique)", len(messages), len(seen))
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected spool files removed after replay, got %d", len(files))
+	}
+}
+
+func TestReplayNotRequeued(t *testing.T) {
+	var status atomic.Int32
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(status.Load()); code != 0 {
+			w.WriteHeader(code)
+			if code == http.StatusMultiStatus {
+				w.Write([]byte(`{"results":[{"status":500},{"status":500}]}`))
+			}
+			return
+		}
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		received.Add(int32(len(data.Events)))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	sender := NewSender(server.URL, "test-key", SpoolDir(t.TempDir()))
+	sender.now = func() time.Time { return now }
+	status.Store(http.StatusServiceUnavailable)
+	sender.Log("first", nil)
+	sender.Log("second", nil)
+	sender.Flush()
+	sender.Flush()
+	if stats := sender.Stats(); stats.Spooled != 2 || stats.Buffered != 0 {
+		t.Fatalf("expected both events spooled, got %+v", stats)
+	}
+
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusMultiStatus} {
+		status.Store(int32(code))
+		if err := sender.Replay(context.Background(), 0); err == nil {
+			t.Errorf("%d: expected the replay interrupted", code)
+		}
+		if n := sender.Stats().Buffered; n != 0 {
+			t.Errorf("%d: expected replayed events left in the spool, not the buffer, got %d buffered", code, n)
+		}
+		now = now.Add(10 * time.Second) // past the 429 backoff
+	}
+
+	status.Store(0)
+	if err := sender.Replay(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	sender.Flush()
+	if n := received.Load(); n != 2 {
+		t.Errorf("expected each spooled event delivered once, got %d deliveries", n)
+	}
+}
+
+func TestReplaySkipsRejectedBatch(t *testing.T) {
+	var status, requests atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", SpoolDir(t.TempDir()))
+	sender.Log("malformed", nil)
+	sender.Flush()
+	sender.Flush()
+	if stats := sender.Stats(); stats.Spooled != 1 {
+		t.Fatalf("expected the event spooled, got %+v", stats)
+	}
+
+	status.Store(http.StatusBadRequest)
+	requests.Store(0)
+	for range 3 {
+		if err := sender.Replay(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected the rejected batch sent once, got %d requests", n)
+	}
+	if stats := sender.Stats(); stats.Dropped != 1 {
+		t.Errorf("expected the event counted as dropped once, got %+v", stats)
+	}
+}
+
+func TestSpoolCompressionAndCap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	const limit = 4096
+	dir := t.TempDir()
+	sender := NewSender(server.URL, "test-key", BatchSize(10), SpoolDir(dir), SpoolMaxBytes(limit))
+	slog.New(sender.NewHandler()).Error("payment failed", "error", errors.New("card declined"))
+	sender.Wait()
+	for range 50 {
+		for range 10 {
+			// Random messages keep gzip from shrinking the spool below the cap.
+			sender.Log(generateTraceID()+generateTraceID()+generateTraceID(), nil)
+		}
+		sender.Flush()
+	}
+	sender.Wait()
+
+	files, _ := os.ReadDir(dir)
+	var total int64
+	var errorSegment bool
+	for _, f := range files {
+		data, _ := os.ReadFile(filepath.Join(dir, f.Name()))
+		if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+			t.Errorf("expected %s to be gzip-compressed", f.Name())
+		}
+		total += int64(len(data))
+		errorSegment = errorSegment || strings.HasSuffix(f.Name(), ".errors.replay")
+	}
+	if total > limit {
+		t.Errorf("expected spool under %d bytes, got %d in %d files", limit, total, len(files))
+	}
+	if !errorSegment {
+		t.Error("expected the segment holding the error event to outlive newer ones")
+	}
+	stats := sender.Stats()
+	if stats.Dropped == 0 || stats.Dropped >= stats.Spooled {
+		t.Errorf("expected old segments rotated out as dropped, got %+v", stats)
+	}
+
+	// Replay decompresses what is left.
+	var replayed atomic.Int32
+	sender = NewSender("", "test-key", SpoolDir(dir), WithTransport(transportFunc(func(_ context.Context, events []Event) error {
+		replayed.Add(int32(len(events)))
+		return nil
+	})))
+	if err := sender.Replay(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Load() == 0 {
+		t.Error("expected the remaining spooled events replayed")
+	}
+}
+
+func TestErrorsJumpFlushBacklog(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	firstBatch := make(chan struct{})
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		mu.Lock()
+		for _, e := range data.Events {
+			order = append(order, e.Message)
+		}
+		mu.Unlock()
+		once.Do(func() { close(firstBatch) })
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key", BatchSize(5))
+	sender.mu.Lock()
+	for i := range 50 {
+		sender.buffer = append(sender.buffer, Event{Message: fmt.Sprintf("info %d", i), Timestamp: "2024-03-01T12:00:00Z"})
+	}
+	sender.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sender.Flush()
+		close(done)
+	}()
+	<-firstBatch
+	sender.Error("payment failed", fmt.Errorf("boom"), nil)
+	<-done
+	sender.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	i := slices.Index(order, "payment failed")
+	if i < 0 || i >= len(order)-5 {
+		t.Errorf("expected the error delivered before the backlog drained, got position %d of %d", i, len(order))
+	}
+}
+
+func TestSendMinLevel(t *testing.T) {
+	h := NewSender("", "test-key", SendMinLevel(slog.LevelWarn)).NewHandler()
+	if !h.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("expected Enabled to stay true below SendMinLevel")
+	}
+	logger := slog.New(h)
+	logger.Debug("local only")
+	logger.Info("local only")
+	logger.Warn("disk almost full")
+
+	events := h.Snapshot()
+	if len(events) != 1 || events[0].Message != "disk almost full" {
+		t.Errorf("expected only the warning buffered for sending, got %+v", events)
+	}
+}
+
+func TestBatchID(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]Event
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Events []Event }
+		json.NewDecoder(r.Body).Decode(&data)
+		mu.Lock()
+		batches = append(batches, data.Events)
+		mu.Unlock()
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusMultiStatus)
+			w.Write([]byte(`{"results":[{"status":200},{"status":503}]}`))
+		}
+	}))
+	defer server.Close()
+
+	sender := NewSender(server.URL, "test-key")
+	sender.Log("a", nil)
+	sender.Log("b", nil)
+	sender.Flush() // b is rejected and retried with the next flush
+	sender.Log("c", nil)
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	first, second := batches[0], batches[1]
+	if first[0].BatchID == "" || first[0].BatchID != first[1].BatchID {
+		t.Errorf("expected events of one batch to share a batch_id, got %q and %q", first[0].BatchID, first[1].BatchID)
+	}
+	if second[0].Message != "b" || second[0].BatchID != first[1].BatchID {
+		t.Errorf("expected the retried event to keep its batch_id, got %+v", second[0])
+	}
+	if second[1].BatchID == first[0].BatchID {
+		t.Error("expected a new batch_id for the second flush")
+	}
+}
+
+func TestErrorsBypassBackoff(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer server.Close()
+
+	for _, bypass := range []bool{false, true} {
+		received.Store(0)
+		sender := NewSender(server.URL, "test-key", ErrorsBypassBackoff(bypass))
+		sender.mu.Lock()
+		sender.backoff = time.Now().Add(time.Minute)
+		sender.mu.Unlock()
+
+		sender.Error("checkout failed", fmt.Errorf("boom"), nil)
+		sender.Log("batched", nil)
+		sender.Wait()
+		sender.Flush()
+
+		want := int32(0)
+		if bypass {
+			want = 1
+		}
+		if got := received.Load(); got != want {
+			t.Errorf("bypass=%v: expected %d requests during backoff, got %d", bypass, want, got)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Package lognorthaws delivers LogNorth events to Amazon Kinesis or SQS
+// instead of the LogNorth API.
+package lognorthaws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	ktypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	stypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	lognorth "github.com/karloscodes/lognorth-sdk-go"
+)
+
+// AWS batch limits, per request.
+const (
+	kinesisMaxRecords     = 500
+	kinesisMaxRecordBytes = 1 << 20 // data plus partition key
+	kinesisMaxBatchBytes  = 5 << 20
+	sqsMaxMessages        = 10
+	sqsMaxBatchBytes      = 1 << 20 // also the per-message limit
+)
+
+// KinesisAPI is the part of *kinesis.Client used by Kinesis.
+type KinesisAPI interface {
+	PutRecords(ctx context.Context, in *kinesis.PutRecordsInput, opts ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error)
+}
+
+// SQSAPI is the part of *sqs.Client used by SQS.
+type SQSAPI interface {
+	SendMessageBatch(ctx context.Context, in *sqs.SendMessageBatchInput, opts ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error)
+}
+
+// Kinesis is a lognorth.Transport that writes each event as one JSON record
+// to a stream, partitioned by event ID.
+type Kinesis struct {
+	client KinesisAPI
+	stream string
+}
+
+// NewKinesis returns a transport writing to the named stream.
+func NewKinesis(client KinesisAPI, stream string) *Kinesis {
+	return &Kinesis{client: client, stream: stream}
+}
+
+// Send splits events into PutRecords calls within the Kinesis limits. Records
+// that fail, alone or with their whole call, are returned in a
+// *lognorth.PartialError.
+func (k *Kinesis) Send(ctx context.Context, events []lognorth.Event) error {
+	records := make([]ktypes.PutRecordsRequestEntry, 0, len(events))
+	sizes := make([]int, 0, len(events))
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		key := partitionKey(e)
+		if size := len(data) + len(key); size > kinesisMaxRecordBytes {
+			return fmt.Errorf("lognorthaws: event of %d bytes exceeds the Kinesis record limit", size)
+		}
+		records = append(records, ktypes.PutRecordsRequestEntry{Data: data, PartitionKey: &key})
+		sizes = append(sizes, len(data)+len(key))
+	}
+	var failed []int
+	var lastErr error
+	for _, span := range chunks(sizes, kinesisMaxRecords, kinesisMaxBatchBytes) {
+		out, err := k.client.PutRecords(ctx, &kinesis.PutRecordsInput{
+			StreamName: &k.stream,
+			Records:    records[span[0]:span[1]],
+		})
+		if err != nil {
+			failed, lastErr = appendSpan(failed, span), err
+			continue
+		}
+		if out.FailedRecordCount != nil && *out.FailedRecordCount > 0 {
+			for i, r := range out.Records {
+				if r.ErrorCode != nil {
+					failed = append(failed, span[0]+i)
+				}
+			}
+			lastErr = fmt.Errorf("lognorthaws: Kinesis rejected %d records", *out.FailedRecordCount)
+		}
+	}
+	return partial(failed, lastErr)
+}
+
+// appendSpan adds the indexes in span to failed.
+func appendSpan(failed []int, span [2]int) []int {
+	for i := span[0]; i < span[1]; i++ {
+		failed = append(failed, i)
+	}
+	return failed
+}
+
+// partial reports the events that were not delivered, so the SDK retries
+// only those instead of rewriting the records that were.
+func partial(failed []int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &lognorth.PartialError{Failed: failed, Err: err}
+}
+
+// partitionKey spreads events across shards; IDs are content hashes.
+func partitionKey(e lognorth.Event) string {
+	if e.ID != "" {
+		return e.ID
+	}
+	return e.Timestamp + e.Message
+}
+
+// SQS is a lognorth.Transport that sends each event as one JSON message to a
+// queue.
+type SQS struct {
+	client   SQSAPI
+	queueURL string
+}
+
+// NewSQS returns a transport sending to the queue at queueURL.
+func NewSQS(client SQSAPI, queueURL string) *SQS {
+	return &SQS{client: client, queueURL: queueURL}
+}
+
+// Send splits events into SendMessageBatch calls within the SQS limits,
+// returning messages that fail in a *lognorth.PartialError.
+func (q *SQS) Send(ctx context.Context, events []lognorth.Event) error {
+	bodies := make([]string, 0, len(events))
+	sizes := make([]int, 0, len(events))
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if len(data) > sqsMaxBatchBytes {
+			return fmt.Errorf("lognorthaws: event of %d bytes exceeds the SQS message limit", len(data))
+		}
+		bodies = append(bodies, string(data))
+		sizes = append(sizes, len(data))
+	}
+	var failed []int
+	var lastErr error
+	for _, span := range chunks(sizes, sqsMaxMessages, sqsMaxBatchBytes) {
+		entries := make([]stypes.SendMessageBatchRequestEntry, 0, span[1]-span[0])
+		for i := span[0]; i < span[1]; i++ {
+			id := strconv.Itoa(i)
+			entries = append(entries, stypes.SendMessageBatchRequestEntry{Id: &id, MessageBody: &bodies[i]})
+		}
+		out, err := q.client.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: &q.queueURL,
+			Entries:  entries,
+		})
+		if err != nil {
+			failed, lastErr = appendSpan(failed, span), err
+			continue
+		}
+		if len(out.Failed) > 0 {
+			for _, f := range out.Failed {
+				if i, err := strconv.Atoi(*f.Id); err == nil {
+					failed = append(failed, i)
+				}
+			}
+			lastErr = fmt.Errorf("lognorthaws: SQS rejected %d messages", len(out.Failed))
+		}
+	}
+	return partial(failed, lastErr)
+}
+
+// chunks splits items with the given sizes into [start, end) spans holding at
+// most maxCount items and maxBytes bytes each. Every item fits on its own.
+func chunks(sizes []int, maxCount, maxBytes int) [][2]int {
+	var spans [][2]int
+	start, total := 0, 0
+	for i, size := range sizes {
+		if i > start && (i-start == maxCount || total+size > maxBytes) {
+			spans = append(spans, [2]int{start, i})
+			start, total = i, 0
+		}
+		total += size
+	}
+	if start < len(sizes) {
+		spans = append(spans, [2]int{start, len(sizes)})
+	}
+	return spans
+}
@@ -0,0 +1,164 @@
+package lognorthaws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	ktypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	stypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	lognorth "github.com/karloscodes/lognorth-sdk-go"
+)
+
+type mockKinesis struct {
+	calls   []*kinesis.PutRecordsInput
+	respond func(call int, in *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+}
+
+func (m *mockKinesis) PutRecords(_ context.Context, in *kinesis.PutRecordsInput, _ ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	m.calls = append(m.calls, in)
+	if m.respond != nil {
+		return m.respond(len(m.calls), in)
+	}
+	return &kinesis.PutRecordsOutput{}, nil
+}
+
+type mockSQS struct {
+	calls   []*sqs.SendMessageBatchInput
+	respond func(call int, in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error)
+}
+
+func (m *mockSQS) SendMessageBatch(_ context.Context, in *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+	m.calls = append(m.calls, in)
+	if m.respond != nil {
+		return m.respond(len(m.calls), in)
+	}
+	return &sqs.SendMessageBatchOutput{}, nil
+}
+
+// failedIndexes returns the PartialError indexes in err.
+func failedIndexes(t *testing.T, err error) []int {
+	t.Helper()
+	var partial *lognorth.PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a *lognorth.PartialError, got %v", err)
+	}
+	return partial.Failed
+}
+
+func events(n, size int) []lognorth.Event {
+	out := make([]lognorth.Event, n)
+	for i := range out {
+		out[i] = lognorth.Event{ID: fmt.Sprint(i), Message: strings.Repeat("x", size)}
+	}
+	return out
+}
+
+func TestKinesisBatching(t *testing.T) {
+	client := &mockKinesis{}
+	if err := NewKinesis(client, "logs").Send(context.Background(), events(1200, 10)); err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, c := range client.calls {
+		if *c.StreamName != "logs" {
+			t.Errorf("expected stream logs, got %s", *c.StreamName)
+		}
+		got = append(got, len(c.Records))
+	}
+	if fmt.Sprint(got) != "[500 500 200]" {
+		t.Errorf("expected record-count batches [500 500 200], got %v", got)
+	}
+
+	// 12 records of ~900 KiB exceed the 5 MiB request limit after 5.
+	client = &mockKinesis{}
+	if err := NewKinesis(client, "logs").Send(context.Background(), events(12, 900<<10)); err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, c := range client.calls {
+		got = append(got, len(c.Records))
+	}
+	if fmt.Sprint(got) != "[5 5 2]" {
+		t.Errorf("expected byte-limited batches [5 5 2], got %v", got)
+	}
+
+	if err := NewKinesis(&mockKinesis{}, "logs").Send(context.Background(), events(1, 2<<20)); err == nil {
+		t.Error("expected an error for an event over the record limit")
+	}
+}
+
+func TestKinesisPartialFailure(t *testing.T) {
+	// The first call fails record 2 of 500; the third call fails outright.
+	client := &mockKinesis{respond: func(call int, in *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+		switch call {
+		case 1:
+			out := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int32(1), Records: make([]ktypes.PutRecordsResultEntry, len(in.Records))}
+			out.Records[2].ErrorCode = aws.String("ProvisionedThroughputExceededException")
+			return out, nil
+		case 3:
+			return nil, errors.New("stream unavailable")
+		}
+		return &kinesis.PutRecordsOutput{}, nil
+	}}
+	got := failedIndexes(t, NewKinesis(client, "logs").Send(context.Background(), events(1003, 10)))
+	if want := "[2 1000 1001 1002]"; fmt.Sprint(got) != want {
+		t.Errorf("expected failed records %s, got %v", want, got)
+	}
+}
+
+func TestSQSPartialFailure(t *testing.T) {
+	client := &mockSQS{respond: func(call int, in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+		if call == 2 {
+			return &sqs.SendMessageBatchOutput{Failed: []stypes.BatchResultErrorEntry{{Id: in.Entries[4].Id}}}, nil
+		}
+		return &sqs.SendMessageBatchOutput{}, nil
+	}}
+	if got := failedIndexes(t, NewSQS(client, "https://sqs.example/q").Send(context.Background(), events(25, 10))); fmt.Sprint(got) != "[14]" {
+		t.Errorf("expected failed message [14], got %v", got)
+	}
+}
+
+func TestSQSBatching(t *testing.T) {
+	client := &mockSQS{}
+	if err := NewSQS(client, "https://sqs.example/q").Send(context.Background(), events(25, 10)); err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, c := range client.calls {
+		got = append(got, len(c.Entries))
+	}
+	if fmt.Sprint(got) != "[10 10 5]" {
+		t.Errorf("expected message-count batches [10 10 5], got %v", got)
+	}
+
+	// 4 messages of ~300 KiB exceed the 1 MiB batch limit after 3.
+	client = &mockSQS{}
+	if err := NewSQS(client, "https://sqs.example/q").Send(context.Background(), events(4, 300<<10)); err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, c := range client.calls {
+		got = append(got, len(c.Entries))
+	}
+	if fmt.Sprint(got) != "[3 1]" {
+		t.Errorf("expected byte-limited batches [3 1], got %v", got)
+	}
+}
+
+func TestSQSTransport(t *testing.T) {
+	client := &mockSQS{}
+	sender := lognorth.NewSender("", "", lognorth.WithTransport(NewSQS(client, "https://sqs.example/q")))
+	slog.New(sender.NewHandler()).Info("queued", "order_id", 42)
+	sender.Flush()
+
+	if len(client.calls) != 1 || !strings.Contains(*client.calls[0].Entries[0].MessageBody, `"message":"queued"`) {
+		t.Fatalf("expected the event delivered through SQS, got %+v", client.calls)
+	}
+}
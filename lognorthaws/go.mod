@@ -0,0 +1,19 @@
+module github.com/karloscodes/lognorth-sdk-go/lognorthaws
+
+go 1.25.3
+
+require (
+	github.com/aws/aws-sdk-go-v2 v1.47.1
+	github.com/aws/aws-sdk-go-v2/service/kinesis v1.56.1
+	github.com/aws/aws-sdk-go-v2/service/sqs v1.52.1
+	github.com/karloscodes/lognorth-sdk-go v0.1.0
+)
+
+require (
+	github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream v1.7.20 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/configsources v1.5.4 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.8.4 // indirect
+	github.com/aws/smithy-go v1.28.1 // indirect
+)
+
+replace github.com/karloscodes/lognorth-sdk-go => ../
@@ -0,0 +1,12 @@
+module github.com/karloscodes/lognorth-sdk-go/lognorthotel
+
+go 1.25.3
+
+require (
+	github.com/karloscodes/lognorth-sdk-go v0.1.0
+	go.opentelemetry.io/otel/trace v1.31.0
+)
+
+require go.opentelemetry.io/otel v1.31.0 // indirect
+
+replace github.com/karloscodes/lognorth-sdk-go => ../
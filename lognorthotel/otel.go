@@ -0,0 +1,25 @@
+// Package lognorthotel correlates LogNorth events with OpenTelemetry traces.
+package lognorthotel
+
+import (
+	"context"
+
+	lognorth "github.com/karloscodes/lognorth-sdk-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SpanContext returns an option that sets trace_id and span_id on events
+// from the active span in the context passed to slog's *Context methods.
+func SpanContext() lognorth.Option {
+	return lognorth.TraceExtractor(Extract)
+}
+
+// Extract returns the trace and span IDs of the span in ctx, or empty strings
+// when there is no valid span.
+func Extract(ctx context.Context) (traceID, spanID string) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return "", ""
+	}
+	return sc.TraceID().String(), sc.SpanID().String()
+}
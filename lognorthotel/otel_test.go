@@ -0,0 +1,57 @@
+package lognorthotel
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	lognorth "github.com/karloscodes/lognorth-sdk-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSpanContext(t *testing.T) {
+	var received []map[string]any
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]any
+		json.Unmarshal(body, &data)
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	sender := lognorth.NewSender(server.URL, "test-key", SpanContext())
+	slog.New(sender.NewHandler()).InfoContext(ctx, "Order placed")
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(received))
+	}
+	event := received[0]["events"].([]any)[0].(map[string]any)
+	if event["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected trace_id from span, got %v", event["trace_id"])
+	}
+	if event["span_id"] != "00f067aa0ba902b7" {
+		t.Errorf("expected span_id from span, got %v", event["span_id"])
+	}
+}
@@ -0,0 +1,46 @@
+// Package lognorthprom exposes LogNorth delivery counters as Prometheus
+// metrics.
+package lognorthprom
+
+import (
+	lognorth "github.com/karloscodes/lognorth-sdk-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterMetrics registers sent, dropped, failed, buffer depth, and backoff
+// metrics for h on reg. Values are read from h.Stats() at scrape time.
+func RegisterMetrics(reg prometheus.Registerer, h *lognorth.Handler) error {
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "lognorth_events_sent_total",
+			Help: "Events accepted by the LogNorth server.",
+		}, func() float64 { return float64(h.Stats().Sent) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "lognorth_events_dropped_total",
+			Help: "Events discarded without delivery.",
+		}, func() float64 { return float64(h.Stats().Dropped) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "lognorth_requests_failed_total",
+			Help: "Batch requests that errored or got a non-2xx response.",
+		}, func() float64 { return float64(h.Stats().Failed) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "lognorth_buffer_events",
+			Help: "Events waiting for the next flush.",
+		}, func() float64 { return float64(h.Stats().Buffered) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "lognorth_backoff",
+			Help: "1 while sends are paused after a 429, 0 otherwise.",
+		}, func() float64 {
+			if h.Stats().BackingOff {
+				return 1
+			}
+			return 0
+		}),
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package lognorthprom
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	lognorth "github.com/karloscodes/lognorth-sdk-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDroppedCounter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	sender := lognorth.NewSender(server.URL, "test-key")
+	h := sender.NewHandler()
+	reg := prometheus.NewRegistry()
+	if err := RegisterMetrics(reg, h); err != nil {
+		t.Fatal(err)
+	}
+
+	slog.New(h).Info("Lost on a 500")
+	sender.Flush()
+	sender.Flush() // the retry fails too
+
+	expected := `
+# HELP lognorth_events_dropped_total Events discarded without delivery.
+# TYPE lognorth_events_dropped_total counter
+lognorth_events_dropped_total 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "lognorth_events_dropped_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/karloscodes/lognorth-sdk-go/lognorthzstd
+
+go 1.25.3
+
+require (
+	github.com/karloscodes/lognorth-sdk-go v0.1.0
+	github.com/klauspost/compress v1.20.1
+)
+
+replace github.com/karloscodes/lognorth-sdk-go => ../
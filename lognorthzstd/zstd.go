@@ -0,0 +1,21 @@
+// Package lognorthzstd registers a zstd codec for lognorth.Compress. Import
+// it for its side effect:
+//
+//	import _ "github.com/karloscodes/lognorth-sdk-go/lognorthzstd"
+//
+//	lognorth.Config(url, key, lognorth.Compress("zstd", "gzip"))
+package lognorthzstd
+
+import (
+	lognorth "github.com/karloscodes/lognorth-sdk-go"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is safe for concurrent EncodeAll calls.
+var encoder, _ = zstd.NewWriter(nil)
+
+func init() {
+	lognorth.RegisterCodec("zstd", func(body []byte) ([]byte, error) {
+		return encoder.EncodeAll(body, make([]byte, 0, len(body)/4)), nil
+	})
+}
@@ -0,0 +1,46 @@
+package lognorthzstd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	lognorth "github.com/karloscodes/lognorth-sdk-go"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestZstdBody(t *testing.T) {
+	var body []byte
+	var encoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	sender := lognorth.NewSender(server.URL, "test-key", lognorth.Compress("zstd", "gzip"))
+	sender.Log("order placed", map[string]any{"order_id": "A-1"})
+	sender.Flush()
+
+	if encoding != "zstd" {
+		t.Fatalf("expected Content-Encoding zstd, got %q", encoding)
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	raw, err := dec.DecodeAll(body, nil)
+	if err != nil {
+		t.Fatalf("expected a zstd body: %v", err)
+	}
+	var batch struct{ Events []lognorth.Event }
+	if err := json.Unmarshal(raw, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Events) != 1 || batch.Events[0].Message != "order placed" || batch.Events[0].Context["order_id"] != "A-1" {
+		t.Errorf("expected the original batch after decompression, got %s", raw)
+	}
+}